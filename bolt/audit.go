@@ -0,0 +1,146 @@
+package bolt
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// ---------------- Audit Log ----------------
+
+// Locals used to pass details from the handlers to the audit middleware.
+const (
+	actorLocal       = "boltbase.actor"
+	auditBucketLocal = "boltbase.auditBucket"
+	auditKeyLocal    = "boltbase.auditKey"
+	routedLocal      = "boltbase.routed"
+)
+
+// routed wraps a route handler so the audit log can tell requests that
+// reached a route from ones that matched nothing.
+func routed(h fiber.Handler) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		c.Locals(routedLocal, true)
+		return h(c)
+	}
+}
+
+// setActor remembers who made the request for the audit log.
+func setActor(c *fiber.Ctx, actor string) {
+	c.Locals(actorLocal, actor)
+}
+
+// auditTarget records the bucket and key of a request that carries them in
+// the body instead of the URL.
+func auditTarget(c *fiber.Ctx, bucket, key string) {
+	c.Locals(auditBucketLocal, bucket)
+	c.Locals(auditKeyLocal, key)
+}
+
+func localString(c *fiber.Ctx, name string) string {
+	s, _ := c.Locals(name).(string)
+	return s
+}
+
+// auditMiddleware writes an AuditEntry for every POST, PUT, PATCH and DELETE
+// that reached a route, once the handler has run, whatever the outcome. It
+// runs after the lockout and rate limit middleware, so rejected requests are
+// not written. Unauthenticated requests answered with 404 are dropped too:
+// anyone can send them and each entry costs a write.
+func auditMiddleware(c *fiber.Ctx) error {
+	switch c.Method() {
+	case fiber.MethodPost, fiber.MethodPut, fiber.MethodPatch, fiber.MethodDelete:
+	default:
+		return c.Next()
+	}
+	db := serverOf(c).db
+	if db.IsReadOnly() {
+		return c.Next()
+	}
+
+	err := c.Next()
+	if c.Locals(routedLocal) == nil {
+		return err
+	}
+	actor := localString(c, actorLocal)
+	if actor == "" && c.Response().StatusCode() == fiber.StatusNotFound {
+		return err
+	}
+
+	e := AuditEntry{
+		Time:   time.Now().UTC(),
+		Actor:  actor,
+		IP:     clientIP(c),
+		Method: c.Method(),
+		Route:  c.Route().Path,
+		Path:   c.Path(),
+		Bucket: localString(c, auditBucketLocal),
+		Key:    localString(c, auditKeyLocal),
+		Status: c.Response().StatusCode(),
+	}
+	if params := c.AllParams(); len(params) > 0 {
+		e.Params = params
+		if e.Bucket == "" {
+			e.Bucket = firstNonEmpty(params["bucketName"], params["oldName"])
+		}
+		if e.Key == "" {
+			e.Key = params["key"]
+		}
+	}
+	if err != nil {
+		e.Status = fiber.StatusInternalServerError
+		var fe *fiber.Error
+		if errors.As(err, &fe) {
+			e.Status = fe.Code
+		}
+		e.Error = err.Error()
+	} else if e.Status >= 400 {
+		e.Error = responseError(c)
+	}
+
+	if err := AppendAudit(db, e); err != nil {
+		log.Printf("Writing audit entry failed: %v", err)
+	}
+	return err
+}
+
+// responseError returns the "error" field of a JSON error response.
+func responseError(c *fiber.Ctx) string {
+	if !strings.HasPrefix(string(c.Response().Header.ContentType()), fiber.MIMEApplicationJSON) {
+		return ""
+	}
+	var body struct {
+		Error string `json:"error"`
+	}
+	json.Unmarshal(c.Response().Body(), &body)
+	return body.Error
+}
+
+func firstNonEmpty(s ...string) string {
+	for _, v := range s {
+		if v != "" {
+			return v
+		}
+	}
+	return ""
+}
+
+// pruneAudit drops entries older than Audit.Retention.
+func (s *server) pruneAudit() {
+	retention := s.Audit.Retention
+	if retention <= 0 {
+		return
+	}
+	n, err := DeleteAuditBefore(s.db, time.Now().Add(-retention))
+	if err != nil {
+		log.Printf("Pruning the audit log failed: %v", err)
+		return
+	}
+	if n > 0 {
+		log.Printf("Pruned %d audit log entries", n)
+	}
+}
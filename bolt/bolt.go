@@ -2,21 +2,21 @@ package bolt
 
 import (
 	"bytes"
-	"embed"
+	"crypto/rand"
 	"encoding/binary"
 	"encoding/json"
 	"errors"
+	"fmt"
+	"strconv"
 
 	"net/url"
 	"os"
+	"sync"
 	"time"
 
 	bolt "github.com/boltdb/bolt"
 )
 
-var WebFS embed.FS
-var DB *bolt.DB
-
 // ---------------- Common Tools ----------------
 
 var ErrKeyNotFound = errors.New("key not found")
@@ -86,14 +86,34 @@ func uint32ToPadded10BE(b []byte) string {
 
 // ---------------- 1. Open/Create Database ----------------
 
-func OpenDB(path string) (*bolt.DB, error) {
+// Options controls how the bolt file is opened and how hard it syncs.
+type Options struct {
+	Timeout         time.Duration `yaml:"timeout"`         // how long to wait for the file lock
+	ReadOnly        bool          `yaml:"readOnly"`        // open with a shared lock; every write fails
+	NoSync          bool          `yaml:"noSync"`          // skip fsync on commit, see SyncInterval
+	NoGrowSync      bool          `yaml:"noGrowSync"`      // skip fsync when the file grows
+	InitialMmapSize int           `yaml:"initialMmapSize"` // initial mmap size in bytes, avoids remapping while readers are open
+	MmapFlags       int           `yaml:"mmapFlags"`       // extra flags passed to mmap, e.g. syscall.MAP_POPULATE
+	SyncInterval    time.Duration `yaml:"syncInterval"`    // with NoSync, fsync this often; bounds the window of lost writes
+}
+
+var DefaultOptions = Options{Timeout: 1 * time.Second}
+
+func OpenDB(path string, opts Options) (*bolt.DB, error) {
 	// if err := validStr(path); err != nil {
 	// 	return nil, err
 	// }
-	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 1 * time.Second})
+	db, err := bolt.Open(path, 0600, &bolt.Options{
+		Timeout:         opts.Timeout,
+		ReadOnly:        opts.ReadOnly,
+		NoGrowSync:      opts.NoGrowSync,
+		InitialMmapSize: opts.InitialMmapSize,
+		MmapFlags:       opts.MmapFlags,
+	})
 	if err != nil {
 		return nil, err
 	}
+	db.NoSync = opts.NoSync
 	return db, nil
 }
 
@@ -129,6 +149,19 @@ func ListBuckets(db *bolt.DB) ([]string, error) {
 	return buckets, err
 }
 
+// ListStoredBuckets returns the bucket names as stored, still escaped the
+// way they appear in URL paths.
+func ListStoredBuckets(db *bolt.DB) ([]string, error) {
+	var buckets []string
+	err := db.View(func(tx *bolt.Tx) error {
+		return tx.ForEach(func(name []byte, b *bolt.Bucket) error {
+			buckets = append(buckets, string(name))
+			return nil
+		})
+	})
+	return buckets, err
+}
+
 func decodeURIComponent(s string) (string, error) {
 	decoded, err := url.QueryUnescape(s)
 	if err != nil {
@@ -186,6 +219,9 @@ func DropBucket(db *bolt.DB, name string) error {
 
 // ---------------- 6. Manual Insert/Update ----------------
 
+// PutKV, PutSeq and PutTime go through groupUpdate so concurrent writers
+// share one transaction and one fsync (see "Group Commit" below).
+
 func PutKV(db *bolt.DB, bucket, key, value string) error {
 	// if err := validStr(bucket); err != nil {
 	// 	return err
@@ -193,7 +229,7 @@ func PutKV(db *bolt.DB, bucket, key, value string) error {
 	// if err := validStr(key); err != nil {
 	// 	return err
 	// }
-	return db.Update(func(tx *bolt.Tx) error {
+	return groupUpdate(db, func(tx *bolt.Tx) error {
 		b := tx.Bucket([]byte(bucket))
 		if b == nil {
 			return ErrBucketNotFound
@@ -204,11 +240,14 @@ func PutKV(db *bolt.DB, bucket, key, value string) error {
 
 // ---------------- 7. Sequential Auto-Increment Insert ----------------
 
-func PutSeq(db *bolt.DB, bucket, value string) error {
+// PutSeq stores value under the bucket's next sequence number and returns the
+// generated key, rendered as a 10-digit zero-padded decimal like the scans do.
+func PutSeq(db *bolt.DB, bucket, value string) (string, error) {
 	// if err := validStr(bucket); err != nil {
 	// 	return err
 	// }
-	return db.Update(func(tx *bolt.Tx) error {
+	var out string
+	err := groupUpdate(db, func(tx *bolt.Tx) error {
 		b := tx.Bucket([]byte(bucket))
 		if b == nil {
 			return ErrBucketNotFound
@@ -220,25 +259,31 @@ func PutSeq(db *bolt.DB, bucket, value string) error {
 		}
 		key := make([]byte, 4)
 		binary.BigEndian.PutUint32(key, uint32(id))
+		out = uint32ToPadded10BE(key)
 		return b.Put(key, []byte(value))
 	})
+	return out, err
 }
 
 // ---------------- 8. Time Auto-Increment Insert ----------------
 
-func PutTime(db *bolt.DB, bucket, value string) error {
+// PutTime stores value under the current UTC time and returns the generated key.
+func PutTime(db *bolt.DB, bucket, value string) (string, error) {
 	// if err := validStr(bucket); err != nil {
 	// 	return err
 	// }
-	return db.Update(func(tx *bolt.Tx) error {
+	var out string
+	err := groupUpdate(db, func(tx *bolt.Tx) error {
 		b := tx.Bucket([]byte(bucket))
 		if b == nil {
 			return ErrBucketNotFound
 		}
 		b.FillPercent = 0.95
-		key := []byte(time.Now().UTC().Format(layoutMicro))
-		return b.Put(key, []byte(value))
+		// 同一个 batch 里的写入可能落在同一微秒，需要跳过已被占用的键
+		out = nextTimeKey(b, time.Time{}).Format(layoutMicro)
+		return b.Put([]byte(out), []byte(value))
 	})
+	return out, err
 }
 
 // ---------------- 9. Get Value ----------------
@@ -543,6 +588,10 @@ func ExportDB(db *bolt.DB, filePath string) error {
 	all := make(map[string]map[string]string)
 	err := db.View(func(tx *bolt.Tx) error {
 		return tx.ForEach(func(name []byte, b *bolt.Bucket) error {
+			// 导出文件里不能出现可以伪造登录令牌的签名密钥
+			if string(name) == secretBucket {
+				return nil
+			}
 			m := make(map[string]string)
 			err := b.ForEach(func(k, v []byte) error {
 				m[string(k)] = string(v)
@@ -613,3 +662,1100 @@ func GetInfo(db *bolt.DB, bucket string) (map[string]int, error) {
 	})
 	return info, err
 }
+
+// ---------------- 19. Named Sequence ----------------
+
+// NextSeq reserves n consecutive values of the named sequence and returns the
+// first one. Sequences start at 1 and are created on first use.
+func NextSeq(db *bolt.DB, name string, n uint64) (uint64, error) {
+	if n == 0 {
+		return 0, errors.New("count must be >0")
+	}
+	var first uint64
+	err := db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists([]byte(sequenceBucket))
+		if err != nil {
+			return err
+		}
+		var cur uint64
+		if v := b.Get([]byte(name)); v != nil {
+			cur = binary.BigEndian.Uint64(v)
+		}
+		if cur+n < cur {
+			return errors.New("sequence overflow")
+		}
+		first = cur + 1
+		next := make([]byte, 8)
+		binary.BigEndian.PutUint64(next, cur+n)
+		return b.Put([]byte(name), next)
+	})
+	return first, err
+}
+
+// GetSeq returns the last value handed out by the named sequence.
+func GetSeq(db *bolt.DB, name string) (uint64, error) {
+	var cur uint64
+	err := db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(sequenceBucket))
+		if b == nil {
+			return ErrKeyNotFound
+		}
+		v := b.Get([]byte(name))
+		if v == nil {
+			return ErrKeyNotFound
+		}
+		cur = binary.BigEndian.Uint64(v)
+		return nil
+	})
+	return cur, err
+}
+
+// ---------------- 20. Bulk Insert ----------------
+
+const bulkChunkSize = 1000
+
+type BulkKV struct {
+	Key   string
+	Value string
+}
+
+type BulkResult struct {
+	Inserted int      `json:"inserted"`
+	Skipped  int      `json:"skipped"`
+	FirstKey string   `json:"firstKey,omitempty"`
+	LastKey  string   `json:"lastKey,omitempty"`
+	Keys     []string `json:"keys,omitempty"`
+}
+
+func (r *BulkResult) add(key string, keep bool) {
+	if r.FirstKey == "" {
+		r.FirstKey = key
+	}
+	r.LastKey = key
+	r.Inserted++
+	if keep {
+		r.Keys = append(r.Keys, key)
+	}
+}
+
+// nextTimeKey returns the first free microsecond key that is not before now
+// and strictly after last, so many inserts in the same instant never collide.
+func nextTimeKey(b *bolt.Bucket, last time.Time) time.Time {
+	t := time.Now().UTC().Truncate(time.Microsecond)
+	if !t.After(last) {
+		t = last.Add(time.Microsecond)
+	}
+	for b.Get([]byte(t.Format(layoutMicro))) != nil {
+		t = t.Add(time.Microsecond)
+	}
+	return t
+}
+
+// bulkChunks runs fn over values in transactions of at most chunk items, so a
+// large import neither holds the writer for too long nor builds a huge tx.
+// Chunks committed before an error stay committed and are reflected in res.
+func bulkChunks(db *bolt.DB, bucket string, n, chunk int, res *BulkResult, fn func(b *bolt.Bucket, i int) error) error {
+	if chunk <= 0 {
+		chunk = bulkChunkSize
+	}
+	for lo := 0; lo < n; lo += chunk {
+		hi := min(lo+chunk, n)
+		saved := *res
+		err := db.Update(func(tx *bolt.Tx) error {
+			b := tx.Bucket([]byte(bucket))
+			if b == nil {
+				return ErrBucketNotFound
+			}
+			for i := lo; i < hi; i++ {
+				if err := fn(b, i); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			*res = saved
+			return err
+		}
+	}
+	return nil
+}
+
+func PutSeqBulk(db *bolt.DB, bucket string, values []string, chunk int, keepKeys bool) (BulkResult, error) {
+	var res BulkResult
+	err := bulkChunks(db, bucket, len(values), chunk, &res, func(b *bolt.Bucket, i int) error {
+		b.FillPercent = 0.95
+		id, err := b.NextSequence()
+		if err != nil {
+			return err
+		}
+		key := make([]byte, 4)
+		binary.BigEndian.PutUint32(key, uint32(id))
+		if err := b.Put(key, []byte(values[i])); err != nil {
+			return err
+		}
+		res.add(uint32ToPadded10BE(key), keepKeys)
+		return nil
+	})
+	return res, err
+}
+
+func PutTimeBulk(db *bolt.DB, bucket string, values []string, chunk int, keepKeys bool) (BulkResult, error) {
+	var (
+		res  BulkResult
+		last time.Time
+	)
+	err := bulkChunks(db, bucket, len(values), chunk, &res, func(b *bolt.Bucket, i int) error {
+		b.FillPercent = 0.95
+		last = nextTimeKey(b, last)
+		key := last.Format(layoutMicro)
+		if err := b.Put([]byte(key), []byte(values[i])); err != nil {
+			return err
+		}
+		res.add(key, keepKeys)
+		return nil
+	})
+	return res, err
+}
+
+// PutKVBulk writes pairs into a string bucket. Pairs with an empty key, or
+// whose key already exists when update is false, are skipped.
+func PutKVBulk(db *bolt.DB, bucket string, pairs []BulkKV, update bool, chunk int, keepKeys bool) (BulkResult, error) {
+	var res BulkResult
+	err := bulkChunks(db, bucket, len(pairs), chunk, &res, func(b *bolt.Bucket, i int) error {
+		k := []byte(pairs[i].Key)
+		if len(k) == 0 || (!update && b.Get(k) != nil) {
+			res.Skipped++
+			return nil
+		}
+		if err := b.Put(k, []byte(pairs[i].Value)); err != nil {
+			return err
+		}
+		res.add(pairs[i].Key, keepKeys)
+		return nil
+	})
+	return res, err
+}
+
+// ---------------- 21. Group Commit ----------------
+
+// groupMax caps how many writes are committed in one transaction.
+const groupMax = 1000
+
+type groupReq struct {
+	fn   func(*bolt.Tx) error
+	done chan error
+}
+
+// groupQueue is the queue of one database's writer; stopped is closed once
+// the writer has committed everything and returned.
+type groupQueue struct {
+	ch      chan *groupReq
+	stopped chan struct{}
+}
+
+var (
+	groupMu sync.RWMutex
+	groups  = make(map[*bolt.DB]groupQueue)
+)
+
+// groupUpdate works like db.Update but lets concurrent callers share a
+// transaction. A single writer goroutine per database commits everything that
+// is queued at that moment, so unlike db.Batch no delay is added when there is
+// no contention. Each caller gets its own result: a function that fails is
+// taken out and the rest of the group is retried without it. fn may therefore
+// run more than once and must only set state it fully overwrites.
+func groupUpdate(db *bolt.DB, fn func(*bolt.Tx) error) error {
+	req := &groupReq{fn: fn, done: make(chan error, 1)}
+	// 持有读锁发送，stopGroupWriter 关闭队列时不会有人正在发送
+	groupMu.RLock()
+	q, ok := groups[db]
+	if ok {
+		q.ch <- req
+	}
+	groupMu.RUnlock()
+	if !ok {
+		groupMu.Lock()
+		if q, ok = groups[db]; !ok {
+			q = groupQueue{ch: make(chan *groupReq, groupMax), stopped: make(chan struct{})}
+			groups[db] = q
+			go groupWriter(db, q)
+		}
+		q.ch <- req
+		groupMu.Unlock()
+	}
+	return <-req.done
+}
+
+// stopGroupWriter commits what is still queued for db and stops its writer.
+// A later groupUpdate starts a new one.
+func stopGroupWriter(db *bolt.DB) {
+	groupMu.Lock()
+	q, ok := groups[db]
+	if ok {
+		close(q.ch)
+		delete(groups, db)
+	}
+	groupMu.Unlock()
+	if ok {
+		<-q.stopped
+	}
+}
+
+func groupWriter(db *bolt.DB, q groupQueue) {
+	defer close(q.stopped)
+	ch := q.ch
+	for req := range ch {
+		group := []*groupReq{req}
+	drain:
+		for len(group) < groupMax {
+			select {
+			case r, ok := <-ch:
+				if !ok {
+					break drain
+				}
+				group = append(group, r)
+			default:
+				break drain
+			}
+		}
+		groupCommit(db, group)
+	}
+}
+
+func groupCommit(db *bolt.DB, group []*groupReq) {
+	for len(group) > 0 {
+		failed := -1
+		err := db.Update(func(tx *bolt.Tx) error {
+			for i, r := range group {
+				if err := callGroupFn(r.fn, tx); err != nil {
+					failed = i
+					return err
+				}
+			}
+			return nil
+		})
+		if failed >= 0 {
+			group[failed].done <- err
+			group = append(group[:failed], group[failed+1:]...)
+			continue
+		}
+		for _, r := range group {
+			r.done <- err
+		}
+		return
+	}
+}
+
+// callGroupFn calls fn and turns a panic into its error, so one caller
+// cannot take down the writer that everyone else is waiting on.
+func callGroupFn(fn func(*bolt.Tx) error, tx *bolt.Tx) (err error) {
+	defer func() {
+		if p := recover(); p != nil {
+			err = fmt.Errorf("panic in group commit: %v", p)
+		}
+	}()
+	return fn(tx)
+}
+
+// ---------------- 22. Admin Credentials ----------------
+//
+// Older versions kept a single admin credential in the admin bucket. It is
+// moved into the user bucket as an admin user: hashed entries on startup,
+// plain "Basic ..." entries on the first successful login (the password is
+// needed to hash them).
+
+const (
+	adminUserKey   = "username"
+	adminHashKey   = "passwordHash"
+	adminLegacyKey = "authToken"
+)
+
+// AdminCredential is the legacy content of the admin bucket.
+type AdminCredential struct {
+	Username string
+	Hash     string
+	Legacy   string
+}
+
+func GetAdminCredential(db *bolt.DB) (AdminCredential, error) {
+	var cred AdminCredential
+	err := db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(adminBucket))
+		if b == nil {
+			return ErrBucketNotFound
+		}
+		cred.Username = string(b.Get([]byte(adminUserKey)))
+		cred.Hash = string(b.Get([]byte(adminHashKey)))
+		cred.Legacy = string(b.Get([]byte(adminLegacyKey)))
+		return nil
+	})
+	return cred, err
+}
+
+// ReplaceAdminCredential stores u as a user and removes the legacy
+// credential from the admin bucket in the same transaction.
+func ReplaceAdminCredential(db *bolt.DB, u User) error {
+	return db.Update(func(tx *bolt.Tx) error {
+		users, err := tx.CreateBucketIfNotExists([]byte(userBucket))
+		if err != nil {
+			return err
+		}
+		if users.Get([]byte(u.Username)) == nil {
+			if err := putUser(users, u); err != nil {
+				return err
+			}
+		}
+		b := tx.Bucket([]byte(adminBucket))
+		if b == nil {
+			return nil
+		}
+		for _, k := range []string{adminUserKey, adminHashKey, adminLegacyKey} {
+			if err := b.Delete([]byte(k)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// MigrateAdminCredential moves a hashed legacy admin credential into the user
+// bucket and reports whether there was one.
+func MigrateAdminCredential(db *bolt.DB) (bool, error) {
+	cred, err := GetAdminCredential(db)
+	if err == ErrBucketNotFound || (err == nil && cred.Hash == "") {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	now := time.Now().UTC()
+	u := User{Username: cred.Username, Hash: cred.Hash, Role: RoleAdmin, Created: now, Updated: now}
+	return true, ReplaceAdminCredential(db, u)
+}
+
+// ---------------- 23. API Keys ----------------
+
+// APIKey is an API key record, keyed by ID in the api key bucket. Only a hash
+// of the token is stored; the token itself is shown once when it is created.
+type APIKey struct {
+	ID       string    `json:"id"`
+	Prefix   string    `json:"prefix"` // non-secret start of the token, for display
+	Hash     string    `json:"hash"`   // hex sha256 of the token
+	Label    string    `json:"label,omitempty"`
+	Owner    string    `json:"owner,omitempty"`
+	Scopes   []string  `json:"scopes"` // empty = no access, see scope.go
+	Created  time.Time `json:"created"`
+	Expiry   time.Time `json:"expiry"`
+	LastUsed time.Time `json:"lastUsed,omitzero"` // flushed periodically, see flushAPIKeyUsage
+	Limits   *Limits   `json:"limits,omitempty"`  // overrides Config.RateLimit
+	Signing  bool      `json:"signing,omitempty"` // only usable for signed requests, see signing.go
+
+	// AllowedCIDRs restricts the client IPs the key may be used from,
+	// empty = any, see clientip.go
+	AllowedCIDRs []string `json:"allowedCIDRs,omitempty"`
+
+	// rotation lineage
+	Replaces   string `json:"replaces,omitempty"`
+	ReplacedBy string `json:"replacedBy,omitempty"`
+}
+
+// UnmarshalJSON reads records without a scopes field, written before
+// scopes existed, as unrestricted ("*"); an empty list stays empty.
+func (k *APIKey) UnmarshalJSON(data []byte) error {
+	type record APIKey
+	r := record{Scopes: []string{scopeAll}}
+	if err := json.Unmarshal(data, &r); err != nil {
+		return err
+	}
+	*k = APIKey(r)
+	return nil
+}
+
+func GetAPIKey(db *bolt.DB, id string) (APIKey, error) {
+	var key APIKey
+	err := db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(apiKeyBucket))
+		if b == nil {
+			return ErrKeyNotFound
+		}
+		v := b.Get([]byte(id))
+		if v == nil {
+			return ErrKeyNotFound
+		}
+		return json.Unmarshal(v, &key)
+	})
+	return key, err
+}
+
+// PutAPIKey stores key, creating the api key bucket if needed.
+func PutAPIKey(db *bolt.DB, key APIKey) error {
+	data, err := json.Marshal(key)
+	if err != nil {
+		return err
+	}
+	return db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists([]byte(apiKeyBucket))
+		if err != nil {
+			return err
+		}
+		return b.Put([]byte(key.ID), data)
+	})
+}
+
+// ListAPIKeys returns all keys ordered by id.
+func ListAPIKeys(db *bolt.DB) ([]APIKey, error) {
+	keys := []APIKey{}
+	err := db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(apiKeyBucket))
+		if b == nil {
+			return nil
+		}
+		return b.ForEach(func(k, v []byte) error {
+			var key APIKey
+			if err := json.Unmarshal(v, &key); err != nil {
+				return err
+			}
+			keys = append(keys, key)
+			return nil
+		})
+	})
+	return keys, err
+}
+
+// UpdateAPIKey applies fn to the stored key and saves the result.
+func UpdateAPIKey(db *bolt.DB, id string, fn func(*APIKey) error) (APIKey, error) {
+	var key APIKey
+	err := db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(apiKeyBucket))
+		if b == nil {
+			return ErrKeyNotFound
+		}
+		v := b.Get([]byte(id))
+		if v == nil {
+			return ErrKeyNotFound
+		}
+		if err := json.Unmarshal(v, &key); err != nil {
+			return err
+		}
+		if err := fn(&key); err != nil {
+			return err
+		}
+		data, err := json.Marshal(key)
+		if err != nil {
+			return err
+		}
+		return b.Put([]byte(id), data)
+	})
+	return key, err
+}
+
+// RotateAPIKey loads key id, lets fn update it and build its replacement, and
+// stores both in one transaction.
+func RotateAPIKey(db *bolt.DB, id string, fn func(old *APIKey) (APIKey, error)) (APIKey, APIKey, error) {
+	var old, repl APIKey
+	err := db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(apiKeyBucket))
+		if b == nil {
+			return ErrKeyNotFound
+		}
+		v := b.Get([]byte(id))
+		if v == nil {
+			return ErrKeyNotFound
+		}
+		if err := json.Unmarshal(v, &old); err != nil {
+			return err
+		}
+		var err error
+		if repl, err = fn(&old); err != nil {
+			return err
+		}
+		for _, key := range []APIKey{old, repl} {
+			data, err := json.Marshal(key)
+			if err != nil {
+				return err
+			}
+			if err := b.Put([]byte(key.ID), data); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	return old, repl, err
+}
+
+func DeleteAPIKey(db *bolt.DB, id string) error {
+	return db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(apiKeyBucket))
+		if b == nil || b.Get([]byte(id)) == nil {
+			return ErrKeyNotFound
+		}
+		return b.Delete([]byte(id))
+	})
+}
+
+// TouchAPIKeys records last-used times in one transaction. Keys that were
+// deleted in the meantime are skipped.
+func TouchAPIKeys(db *bolt.DB, used map[string]time.Time) error {
+	return db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(apiKeyBucket))
+		if b == nil {
+			return nil
+		}
+		for id, t := range used {
+			v := b.Get([]byte(id))
+			if v == nil {
+				continue
+			}
+			var key APIKey
+			if err := json.Unmarshal(v, &key); err != nil {
+				return err
+			}
+			if !t.After(key.LastUsed) {
+				continue
+			}
+			key.LastUsed = t
+			data, err := json.Marshal(key)
+			if err != nil {
+				return err
+			}
+			if err := b.Put([]byte(id), data); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// DeleteExpiredAPIKeys removes every key that expired before now.
+func DeleteExpiredAPIKeys(db *bolt.DB, now time.Time) (int, error) {
+	n := 0
+	err := db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(apiKeyBucket))
+		if b == nil {
+			return nil
+		}
+		var expired [][]byte
+		err := b.ForEach(func(k, v []byte) error {
+			var key APIKey
+			if err := json.Unmarshal(v, &key); err != nil {
+				return err
+			}
+			if key.Expiry.Before(now) {
+				expired = append(expired, k)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for _, k := range expired {
+			if err := b.Delete(k); err != nil {
+				return err
+			}
+		}
+		n = len(expired)
+		return nil
+	})
+	return n, err
+}
+
+// MigrateAPIKeys converts keys stored by older versions (token -> RFC3339
+// expiry) into hashed APIKey records and returns how many were converted.
+func MigrateAPIKeys(db *bolt.DB) (int, error) {
+	n := 0
+	err := db.Update(func(tx *bolt.Tx) error {
+		if m := tx.Bucket([]byte(metadataBucket)); m != nil {
+			if err := m.Delete([]byte(apiKeyBucket)); err != nil {
+				return err
+			}
+		}
+		b := tx.Bucket([]byte(apiKeyBucket))
+		if b == nil {
+			return nil
+		}
+		legacy := make(map[string]string)
+		err := b.ForEach(func(k, v []byte) error {
+			if len(v) > 0 && v[0] != '{' {
+				legacy[string(k)] = string(v)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for token, expiry := range legacy {
+			t, err := time.Parse(time.RFC3339, expiry)
+			if err != nil {
+				return fmt.Errorf("api key %s: %v", legacyAPIKeyID(hashAPIKey(token)), err)
+			}
+			key := APIKey{Hash: hashAPIKey(token), Scopes: []string{scopeAll}, Created: time.Now().UTC(), Expiry: t}
+			key.ID = legacyAPIKeyID(key.Hash)
+			if b.Get([]byte(key.ID)) != nil {
+				return fmt.Errorf("api key %s: id already taken", key.ID)
+			}
+			data, err := json.Marshal(key)
+			if err != nil {
+				return err
+			}
+			if err := b.Put([]byte(key.ID), data); err != nil {
+				return err
+			}
+			if err := b.Delete([]byte(token)); err != nil {
+				return err
+			}
+			n++
+		}
+		return nil
+	})
+	return n, err
+}
+
+// ---------------- 24. Users ----------------
+
+const (
+	RoleAdmin  = "admin"
+	RoleEditor = "editor"
+	RoleViewer = "viewer"
+)
+
+var (
+	ErrUserExists = errors.New("user already exists")
+	ErrLastAdmin  = errors.New("at least one enabled admin is required")
+)
+
+type User struct {
+	Username string    `json:"username"`
+	Hash     string    `json:"hash"` // argon2id, see password.go
+	Role     string    `json:"role"`
+	Disabled bool      `json:"disabled,omitempty"`
+	Limits   *Limits   `json:"limits,omitempty"` // overrides Config.RateLimit
+	Created  time.Time `json:"created"`
+	Updated  time.Time `json:"updated"`
+}
+
+func putUser(b *bolt.Bucket, u User) error {
+	data, err := json.Marshal(u)
+	if err != nil {
+		return err
+	}
+	return b.Put([]byte(u.Username), data)
+}
+
+// enabledAdmins counts the admins that can still log in.
+func enabledAdmins(b *bolt.Bucket) (int, error) {
+	n := 0
+	err := b.ForEach(func(k, v []byte) error {
+		var u User
+		if err := json.Unmarshal(v, &u); err != nil {
+			return err
+		}
+		if u.Role == RoleAdmin && !u.Disabled {
+			n++
+		}
+		return nil
+	})
+	return n, err
+}
+
+func GetUser(db *bolt.DB, username string) (User, error) {
+	var u User
+	err := db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(userBucket))
+		if b == nil {
+			return ErrKeyNotFound
+		}
+		v := b.Get([]byte(username))
+		if v == nil {
+			return ErrKeyNotFound
+		}
+		return json.Unmarshal(v, &u)
+	})
+	return u, err
+}
+
+// ListUsers returns all users ordered by name.
+func ListUsers(db *bolt.DB) ([]User, error) {
+	users := []User{}
+	err := db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(userBucket))
+		if b == nil {
+			return nil
+		}
+		return b.ForEach(func(k, v []byte) error {
+			var u User
+			if err := json.Unmarshal(v, &u); err != nil {
+				return err
+			}
+			users = append(users, u)
+			return nil
+		})
+	})
+	return users, err
+}
+
+// CreateUser adds a new user; it fails with ErrUserExists if the name is taken.
+func CreateUser(db *bolt.DB, u User) error {
+	return db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists([]byte(userBucket))
+		if err != nil {
+			return err
+		}
+		if b.Get([]byte(u.Username)) != nil {
+			return ErrUserExists
+		}
+		return putUser(b, u)
+	})
+}
+
+// UpdateUser applies fn to the stored user and saves the result. The update
+// is rejected with ErrLastAdmin if it would leave no enabled admin.
+func UpdateUser(db *bolt.DB, username string, fn func(*User) error) (User, error) {
+	var u User
+	err := db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(userBucket))
+		if b == nil {
+			return ErrKeyNotFound
+		}
+		v := b.Get([]byte(username))
+		if v == nil {
+			return ErrKeyNotFound
+		}
+		if err := json.Unmarshal(v, &u); err != nil {
+			return err
+		}
+		if err := fn(&u); err != nil {
+			return err
+		}
+		if err := putUser(b, u); err != nil {
+			return err
+		}
+		n, err := enabledAdmins(b)
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			return ErrLastAdmin
+		}
+		return nil
+	})
+	return u, err
+}
+
+// DeleteUser removes a user unless it is the last enabled admin.
+func DeleteUser(db *bolt.DB, username string) error {
+	return db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(userBucket))
+		if b == nil || b.Get([]byte(username)) == nil {
+			return ErrKeyNotFound
+		}
+		if err := b.Delete([]byte(username)); err != nil {
+			return err
+		}
+		n, err := enabledAdmins(b)
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			return ErrLastAdmin
+		}
+		return nil
+	})
+}
+
+// ---------------- 25. Sessions & Secrets ----------------
+
+// Session is a login session created by POST /auth/login. Only a hash of its
+// refresh token is stored.
+type Session struct {
+	ID       string    `json:"id"`
+	Username string    `json:"username"`
+	Hash     string    `json:"hash"`          // hex sha256 of the current refresh token
+	Web      bool      `json:"web,omitempty"` // web console session, the token is the cookie
+	Created  time.Time `json:"created"`
+	Expiry   time.Time `json:"expiry"`
+}
+
+func GetSession(db *bolt.DB, id string) (Session, error) {
+	var sess Session
+	err := db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(sessionBucket))
+		if b == nil {
+			return ErrKeyNotFound
+		}
+		v := b.Get([]byte(id))
+		if v == nil {
+			return ErrKeyNotFound
+		}
+		return json.Unmarshal(v, &sess)
+	})
+	return sess, err
+}
+
+func PutSession(db *bolt.DB, sess Session) error {
+	data, err := json.Marshal(sess)
+	if err != nil {
+		return err
+	}
+	return db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists([]byte(sessionBucket))
+		if err != nil {
+			return err
+		}
+		return b.Put([]byte(sess.ID), data)
+	})
+}
+
+func DeleteSession(db *bolt.DB, id string) error {
+	return db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(sessionBucket))
+		if b == nil || b.Get([]byte(id)) == nil {
+			return ErrKeyNotFound
+		}
+		return b.Delete([]byte(id))
+	})
+}
+
+// DeleteSessions removes the sessions for which match returns true and
+// returns how many were removed.
+func DeleteSessions(db *bolt.DB, match func(Session) bool) (int, error) {
+	n := 0
+	err := db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(sessionBucket))
+		if b == nil {
+			return nil
+		}
+		var ids [][]byte
+		err := b.ForEach(func(k, v []byte) error {
+			var sess Session
+			if err := json.Unmarshal(v, &sess); err != nil {
+				return err
+			}
+			if match(sess) {
+				ids = append(ids, k)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for _, k := range ids {
+			if err := b.Delete(k); err != nil {
+				return err
+			}
+		}
+		n = len(ids)
+		return nil
+	})
+	return n, err
+}
+
+// GetSecret returns the named server secret, creating n random bytes on
+// first use.
+func GetSecret(db *bolt.DB, name string, n int) ([]byte, error) {
+	var secret []byte
+	err := db.View(func(tx *bolt.Tx) error {
+		if b := tx.Bucket([]byte(secretBucket)); b != nil {
+			secret = bytes.Clone(b.Get([]byte(name)))
+		}
+		return nil
+	})
+	if err != nil || secret != nil {
+		return secret, err
+	}
+	if db.IsReadOnly() {
+		return nil, ErrKeyNotFound
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists([]byte(secretBucket))
+		if err != nil {
+			return err
+		}
+		if v := b.Get([]byte(name)); v != nil {
+			secret = bytes.Clone(v)
+			return nil
+		}
+		secret = make([]byte, n)
+		if _, err := rand.Read(secret); err != nil {
+			return err
+		}
+		return b.Put([]byte(name), secret)
+	})
+	return secret, err
+}
+
+// ---------------- 26. Audit Log ----------------
+
+// AuditEntry records one mutating request. Entries are keyed by time so a
+// time range is a cursor seek.
+type AuditEntry struct {
+	Time   time.Time         `json:"time"`
+	Actor  string            `json:"actor,omitempty"` // empty when authentication failed
+	IP     string            `json:"ip"`
+	Method string            `json:"method"`
+	Route  string            `json:"route"`
+	Path   string            `json:"path"`
+	Bucket string            `json:"bucket,omitempty"`
+	Key    string            `json:"key,omitempty"`
+	Params map[string]string `json:"params,omitempty"`
+	Status int               `json:"status"`
+	Error  string            `json:"error,omitempty"`
+}
+
+// auditTimeFormat is fixed width so keys sort by time.
+const auditTimeFormat = "2006-01-02T15:04:05.000000000Z"
+
+// AppendAudit stores e. It goes through groupUpdate, so concurrent calls
+// share a commit with each other and with the writes they record.
+func AppendAudit(db *bolt.DB, e AuditEntry) error {
+	data, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	return groupUpdate(db, func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists([]byte(auditBucket))
+		if err != nil {
+			return err
+		}
+		seq, err := b.NextSequence()
+		if err != nil {
+			return err
+		}
+		// 同一纳秒内的多条记录靠序号区分
+		key := fmt.Sprintf("%s-%016x", e.Time.UTC().Format(auditTimeFormat), seq)
+		return b.Put([]byte(key), data)
+	})
+}
+
+// ListAudit calls fn for the entries in [from, to), newest first, until fn
+// returns false. A zero from or to leaves that end open.
+func ListAudit(db *bolt.DB, from, to time.Time, fn func(AuditEntry) bool) error {
+	return db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(auditBucket))
+		if b == nil {
+			return nil
+		}
+		var min []byte
+		if !from.IsZero() {
+			min = []byte(from.UTC().Format(auditTimeFormat))
+		}
+		c := b.Cursor()
+		var k, v []byte
+		if to.IsZero() {
+			k, v = c.Last()
+		} else if k, v = c.Seek([]byte(to.UTC().Format(auditTimeFormat))); k == nil {
+			k, v = c.Last()
+		} else {
+			k, v = c.Prev()
+		}
+		for ; k != nil; k, v = c.Prev() {
+			if min != nil && bytes.Compare(k, min) < 0 {
+				return nil
+			}
+			var e AuditEntry
+			if err := json.Unmarshal(v, &e); err != nil {
+				return err
+			}
+			if !fn(e) {
+				return nil
+			}
+		}
+		return nil
+	})
+}
+
+// DeleteAuditBefore removes the entries older than t and returns how many
+// were removed.
+func DeleteAuditBefore(db *bolt.DB, t time.Time) (int, error) {
+	n := 0
+	err := db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(auditBucket))
+		if b == nil {
+			return nil
+		}
+		max := []byte(t.UTC().Format(auditTimeFormat))
+		var keys [][]byte
+		c := b.Cursor()
+		for k, _ := c.First(); k != nil && bytes.Compare(k, max) < 0; k, _ = c.Next() {
+			keys = append(keys, k)
+		}
+		for _, k := range keys {
+			if err := b.Delete(k); err != nil {
+				return err
+			}
+		}
+		n = len(keys)
+		return nil
+	})
+	return n, err
+}
+
+// ---------------- 27. Quota Usage ----------------
+
+// GetQuotaUsage returns the stored request count under key.
+func GetQuotaUsage(db *bolt.DB, key string) (int64, error) {
+	var n int64
+	err := db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(quotaBucket))
+		if b == nil {
+			return nil
+		}
+		v := b.Get([]byte(key))
+		if v == nil {
+			return nil
+		}
+		var err error
+		n, err = strconv.ParseInt(string(v), 10, 64)
+		return err
+	})
+	return n, err
+}
+
+// AddQuotaUsage adds the deltas to the stored counts.
+func AddQuotaUsage(db *bolt.DB, deltas map[string]int64) error {
+	if len(deltas) == 0 {
+		return nil
+	}
+	return db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists([]byte(quotaBucket))
+		if err != nil {
+			return err
+		}
+		for key, d := range deltas {
+			var n int64
+			if v := b.Get([]byte(key)); v != nil {
+				if n, err = strconv.ParseInt(string(v), 10, 64); err != nil {
+					return err
+				}
+			}
+			if err := b.Put([]byte(key), []byte(strconv.FormatInt(n+d, 10))); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// DeleteQuotaUsageBefore removes the counts whose key sorts before min.
+func DeleteQuotaUsageBefore(db *bolt.DB, min string) (int, error) {
+	n := 0
+	err := db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(quotaBucket))
+		if b == nil {
+			return nil
+		}
+		var keys [][]byte
+		c := b.Cursor()
+		for k, _ := c.First(); k != nil && string(k) < min; k, _ = c.Next() {
+			keys = append(keys, k)
+		}
+		for _, k := range keys {
+			if err := b.Delete(k); err != nil {
+				return err
+			}
+		}
+		n = len(keys)
+		return nil
+	})
+	return n, err
+}
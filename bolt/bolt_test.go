@@ -0,0 +1,188 @@
+package bolt
+
+import (
+	"embed"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	bolt "github.com/boltdb/bolt"
+	"github.com/gofiber/fiber/v2"
+	"github.com/valyala/fasthttp"
+)
+
+const testPassword = "correct horse battery staple"
+
+// newTestApp returns an app on a fresh database with an admin user "admin"
+// (password testPassword), so every request needs credentials. Lockouts
+// are off unless configure turns them on.
+func newTestApp(t *testing.T, configure func(*Config)) (*fiber.App, *server) {
+	t.Helper()
+	db, err := InitDB(filepath.Join(t.TempDir(), "test.db"), DefaultOptions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { CloseDB(db) })
+	for _, name := range []string{adminBucket, apiKeyBucket} {
+		if err := CreateBucket(db, name); err != nil {
+			t.Fatal(err)
+		}
+	}
+	hash, err := hashPassword(testPassword)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := CreateUser(db, User{Username: "admin", Hash: hash, Role: RoleAdmin}); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := DefaultConfig()
+	cfg.Log.Disable = true
+	cfg.Auth.Lockout.Threshold = 0
+	if configure != nil {
+		configure(&cfg)
+	}
+	app, srv, err := newApp(cfg, db, Routes, embed.FS{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return app, srv
+}
+
+// newTestAPIKey stores key under a fresh id and returns its token. The key
+// expires in an hour unless it says otherwise.
+func newTestAPIKey(t *testing.T, db *bolt.DB, key APIKey) string {
+	t.Helper()
+	token, id, err := newAPIKeyToken()
+	if err != nil {
+		t.Fatal(err)
+	}
+	key.ID, key.Prefix, key.Hash = id, apiKeyTokenPrefix+id, hashAPIKey(token)
+	if key.Expiry.IsZero() {
+		key.Expiry = time.Now().Add(time.Hour)
+	}
+	if err := PutAPIKey(db, key); err != nil {
+		t.Fatal(err)
+	}
+	return token
+}
+
+// authenticateFrom runs authenticate on req as if it arrived from remote.
+func authenticateFrom(app *fiber.App, srv *server, req *fasthttp.Request, remote string) (AuthResult, error) {
+	var fctx fasthttp.RequestCtx
+	fctx.Init(req, &net.TCPAddr{IP: net.ParseIP(remote), Port: 40000}, nil)
+	c := app.AcquireCtx(&fctx)
+	defer app.ReleaseCtx(c)
+	c.Locals(serverLocal, srv)
+	return authenticate(c)
+}
+
+func benchDB(b *testing.B) *bolt.DB {
+	db, err := bolt.Open(filepath.Join(b.TempDir(), "bench.db"), 0600, nil)
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.Cleanup(func() { CloseDB(db) })
+	if err := db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucket([]byte("bench"))
+		return err
+	}); err != nil {
+		b.Fatal(err)
+	}
+	return db
+}
+
+// TestGroupUpdatePanic checks that a panicking function fails only its own
+// call and leaves the writer running for the others.
+func TestGroupUpdatePanic(t *testing.T) {
+	db, err := bolt.Open(filepath.Join(t.TempDir(), "panic.db"), 0600, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { CloseDB(db) })
+
+	put := func(key string) func(*bolt.Tx) error {
+		return func(tx *bolt.Tx) error {
+			b, err := tx.CreateBucketIfNotExists([]byte("t"))
+			if err != nil {
+				return err
+			}
+			return b.Put([]byte(key), []byte(key))
+		}
+	}
+	var wg sync.WaitGroup
+	errs := make([]error, 10)
+	for i := range errs {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if i == 3 {
+				errs[i] = groupUpdate(db, func(*bolt.Tx) error { panic("boom") })
+				return
+			}
+			errs[i] = groupUpdate(db, put(fmt.Sprint(i)))
+		}()
+	}
+	wg.Wait()
+	for i, err := range errs {
+		if (i == 3) != (err != nil) {
+			t.Errorf("write %d: err = %v", i, err)
+		}
+	}
+	if err := groupUpdate(db, put("after")); err != nil {
+		t.Fatalf("write after the panic: %v", err)
+	}
+}
+
+// BenchmarkGroupUpdate compares db.Update with groupUpdate for single-key
+// writes from 1, 10 and 50 concurrent writers. Every commit is fsync'd, so
+// under contention groupUpdate should take much less time per write:
+//
+//	go test ./bolt -run '^$' -bench GroupUpdate -benchtime 2000x
+func BenchmarkGroupUpdate(b *testing.B) {
+	updates := []struct {
+		name   string
+		update func(*bolt.DB, func(*bolt.Tx) error) error
+	}{
+		{"update", func(db *bolt.DB, fn func(*bolt.Tx) error) error { return db.Update(fn) }},
+		{"group", groupUpdate},
+	}
+	for _, u := range updates {
+		for _, writers := range []int{1, 10, 50} {
+			b.Run(fmt.Sprintf("%s/writers=%d", u.name, writers), func(b *testing.B) {
+				db := benchDB(b)
+				var (
+					next atomic.Uint64
+					wg   sync.WaitGroup
+				)
+				b.ResetTimer()
+				for range writers {
+					wg.Add(1)
+					go func() {
+						defer wg.Done()
+						for {
+							i := next.Add(1)
+							if i > uint64(b.N) {
+								return
+							}
+							key := binary.BigEndian.AppendUint64(nil, i)
+							err := u.update(db, func(tx *bolt.Tx) error {
+								return tx.Bucket([]byte("bench")).Put(key, key)
+							})
+							if err != nil {
+								b.Error(err)
+								return
+							}
+						}
+					}()
+				}
+				wg.Wait()
+			})
+		}
+	}
+}
@@ -1,16 +1,28 @@
 package bolt
 
 import (
+	"context"
+	"crypto/tls"
 	"embed"
+	"errors"
 	"fmt"
 	"io/fs"
 	"log"
+	"net"
 	"net/http"
+	"net/netip"
+	"net/url"
+	"os"
+	"os/signal"
+	"slices"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
 
-	"github.com/gofiber/fiber/v2/middleware/cors"
+	bolt "github.com/boltdb/bolt"
 	"github.com/gofiber/fiber/v2/middleware/filesystem"
-	"github.com/gofiber/fiber/v2/middleware/healthcheck"
 	"github.com/gofiber/fiber/v2/middleware/logger"
 	"github.com/gofiber/template/html/v2"
 
@@ -23,71 +35,330 @@ type Route struct {
 	Handler fiber.Handler
 }
 
-func NewApp(name string, routes []Route, webFS embed.FS) *fiber.App {
+// server is one Boltbase instance: the Config it was made from, its
+// database and the in-memory state of its middleware. Every request carries
+// it in its Locals, see serverOf.
+type server struct {
+	Config
+	db             *bolt.DB
+	webFS          embed.FS
+	trustedProxies []netip.Prefix // Proxy.Trusted, parsed
+	peerAdmins     peerAdmins     // Unix.AdminPeers, resolved
 
+	maintenance  atomic.Bool // set by config or PUT /maintenance/:state, fails readiness
+	shuttingDown atomic.Bool // set once Run received a shutdown signal
+
+	lockouts    *lockoutTable
+	limiters    *limiterTable
+	quotas      *quotaTable
+	nonces      *nonceTable
+	apiKeyUsage *apiKeyUsage
+	tokenKey    *tokenKeyCache
+}
+
+const serverLocal = "boltbase.server"
+
+// serverOf returns the server handling the request.
+func serverOf(c *fiber.Ctx) *server {
+	return c.Locals(serverLocal).(*server)
+}
+
+func newServer(cfg Config, db *bolt.DB, webFS embed.FS) (*server, error) {
+	s := &server{
+		Config:      cfg,
+		db:          db,
+		webFS:       webFS,
+		lockouts:    newLockoutTable(),
+		limiters:    newLimiterTable(),
+		quotas:      newQuotaTable(),
+		nonces:      newNonceTable(),
+		apiKeyUsage: newAPIKeyUsage(),
+		tokenKey:    &tokenKeyCache{},
+	}
+	var err error
+	if s.trustedProxies, err = parsePrefixes(cfg.Proxy.Trusted); err != nil {
+		return nil, fmt.Errorf("proxy.trusted: %v", err)
+	}
+	if s.peerAdmins, err = resolvePeerAdmins(cfg.Unix.AdminPeers); err != nil {
+		return nil, fmt.Errorf("unix.adminPeers: %v", err)
+	}
+	s.maintenance.Store(cfg.Maintenance)
+	return s, nil
+}
+
+// NewApp builds the app serving db. It does not start the background jobs
+// (pruning, flushing usage counters), Run does.
+func NewApp(cfg Config, db *bolt.DB, routes []Route, webFS embed.FS) (*fiber.App, error) {
+	app, _, err := newApp(cfg, db, routes, webFS)
+	return app, err
+}
+
+func newApp(cfg Config, db *bolt.DB, routes []Route, webFS embed.FS) (*fiber.App, *server, error) {
+	srv, err := newServer(cfg, db, webFS)
+	if err != nil {
+		return nil, nil, err
+	}
 	viewSub, err := fs.Sub(webFS, "web/views")
 	if err != nil {
-		log.Fatal(err)
+		return nil, nil, err
+	}
+	staticSub, err := fs.Sub(webFS, "web/public")
+	if err != nil {
+		return nil, nil, err
 	}
 
 	engine := html.NewFileSystem(http.FS(viewSub), ".html")
+	// for bucket names in console paths
+	engine.AddFunc("pathescape", url.PathEscape)
 
 	app := fiber.New(fiber.Config{
-		AppName: name,
-		Views:   engine,
+		AppName:   cfg.Name,
+		Views:     engine,
+		BodyLimit: cfg.BodyLimit,
 	})
 
-	app.Use(cors.New(cors.Config{
-		AllowOriginsFunc: func(origin string) bool { return true },
-		AllowCredentials: true,
-		AllowHeaders:     "Origin, Content-Type, Accept, Authorization, session_token, X-Requested-With, X-Session-Token, X-API-KEY, csrf-token",
-		AllowMethods:     "GET, POST, HEAD, PUT, DELETE, PATCH",
-	}))
+	app.Use(func(c *fiber.Ctx) error {
+		c.Locals(serverLocal, srv)
+		return c.Next()
+	})
+	app.Use(corsMiddleware(cfg.CORS))
 
-	app.Use(logger.New())
+	if !cfg.Log.Disable {
+		logCfg := logger.Config{Format: cfg.Log.Format}
+		if cfg.Log.File != "" {
+			f, err := os.OpenFile(cfg.Log.File, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+			if err != nil {
+				return nil, nil, err
+			}
+			log.SetOutput(f)
+			logCfg.Output = f
+		}
+		app.Use(logger.New(logCfg))
+	}
 
-	app.Use(healthcheck.New(healthcheck.Config{
-		LivenessEndpoint: "/health",
-	}))
+	app.Use(lockoutMiddleware)
+	app.Use(rateLimitMiddleware)
+	app.Use(auditMiddleware)
 
 	for _, r := range routes {
-		app.Add(strings.ToUpper(r.Method), r.Path, r.Handler)
-	}
-
-	staticSub, err := fs.Sub(webFS, "web/public")
-	if err != nil {
-		log.Fatal(err)
+		app.Add(strings.ToUpper(r.Method), r.Path, routed(r.Handler))
 	}
 
 	app.Use("/public", filesystem.New(filesystem.Config{
 		Root: http.FS(staticSub),
 	}))
 
-	return app
+	return app, srv, nil
 }
 
-func Run(name string, port int, routes []Route, webFS embed.FS) {
-	app := NewApp(name, routes, webFS)
-	log.Fatal(app.Listen(fmt.Sprintf(":%d", port)))
+// Run serves db on cfg.Addr and/or cfg.Unix.Path until a listener fails or
+// SIGINT/SIGTERM arrives. On a signal it stops accepting connections and
+// waits up to cfg.ShutdownTimeout for in-flight requests. The background
+// jobs run as long as Run does; before returning it writes what they left
+// pending, and the caller then closes the database with CloseDB. A second
+// signal kills the process right away.
+func Run(cfg Config, db *bolt.DB, routes []Route, webFS embed.FS) error {
+	app, srv, err := newApp(cfg, db, routes, webFS)
+	if err != nil {
+		return err
+	}
+
+	var listeners []net.Listener
+	closeAll := func() {
+		for _, ln := range listeners {
+			ln.Close()
+		}
+	}
+
+	if cfg.Addr != "" {
+		ln, err := net.Listen("tcp", cfg.Addr)
+		if err != nil {
+			return err
+		}
+		listeners = append(listeners, ln)
+	}
+	if cfg.Unix.Path != "" {
+		if len(cfg.Unix.AdminPeers) > 0 {
+			log.Printf("Unix socket %s: peers %v are trusted as admin", cfg.Unix.Path, cfg.Unix.AdminPeers)
+		}
+		ln, err := listenUnix(cfg.Unix)
+		if err != nil {
+			closeAll()
+			return err
+		}
+		listeners = append(listeners, ln)
+	}
+
+	if cfg.TLS.Enabled() && cfg.Addr != "" {
+		reloader, err := newTLSReloader(cfg.TLS)
+		if err != nil {
+			closeAll()
+			return err
+		}
+		listeners[0] = tls.NewListener(listeners[0], reloader.tlsConfig())
+
+		hup := make(chan os.Signal, 1)
+		signal.Notify(hup, syscall.SIGHUP)
+		defer func() {
+			signal.Stop(hup)
+			close(hup)
+		}()
+		go func() {
+			for range hup {
+				if err := reloader.reload(); err != nil {
+					log.Printf("TLS reload failed, keeping the old certificate: %v", err)
+					continue
+				}
+				log.Printf("TLS certificate reloaded")
+			}
+		}()
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	jobsDone := srv.startJobs(ctx)
+	defer func() {
+		stop()
+		<-jobsDone
+		srv.flush()
+	}()
+
+	// 第一个监听器交给 fiber (打印启动信息)，其余的直接挂到同一个 server 上，
+	// 这样 Shutdown 会一起关闭它们。
+	errCh := make(chan error, len(listeners))
+	for i, ln := range listeners {
+		go func() {
+			if i == 0 {
+				errCh <- app.Listener(ln)
+				return
+			}
+			log.Printf("Also listening on %s", ln.Addr())
+			errCh <- app.Server().Serve(ln)
+		}()
+	}
+
+	select {
+	case err := <-errCh:
+		return err
+	case <-ctx.Done():
+	}
+	stop()
+	srv.shuttingDown.Store(true)
+
+	log.Printf("Shutting down, waiting up to %v for in-flight requests", cfg.ShutdownTimeout)
+	if err := app.ShutdownWithTimeout(cfg.ShutdownTimeout); err != nil {
+		log.Printf("Shutdown did not finish cleanly: %v", err)
+	}
+	return nil
 }
 
-func InitDB() error {
-	var err error
-	db, err = OpenDB("./Boltbase.db")
+// startJobs runs the periodic jobs of s until ctx is done. The returned
+// channel is closed once all of them have returned.
+func (s *server) startJobs(ctx context.Context) <-chan struct{} {
+	var wg sync.WaitGroup
+	every := func(interval time.Duration, fn func()) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			t := time.NewTicker(interval)
+			defer t.Stop()
+			for {
+				select {
+				case <-t.C:
+					fn()
+				case <-ctx.Done():
+					return
+				}
+			}
+		}()
+	}
+
+	if s.db.NoSync && s.DB.SyncInterval > 0 && !s.db.IsReadOnly() {
+		every(s.DB.SyncInterval, func() {
+			if err := s.db.Sync(); err != nil {
+				log.Printf("Background sync failed: %v", err)
+			}
+		})
+	}
+	every(10*time.Minute, s.pruneLockouts)
+	every(10*time.Minute, s.pruneLimiters)
+	every(time.Minute, s.pruneNonces)
+	every(quotaFlush, s.flushQuotas)
+	if !s.db.IsReadOnly() {
+		every(apiKeyUsageFlush, s.flushAPIKeyUsage)
+		every(time.Hour, s.deleteExpiredSessions)
+		every(time.Hour, s.pruneAudit)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	return done
+}
+
+// flush writes the usage counters the jobs have not written yet.
+func (s *server) flush() {
+	if !s.db.IsReadOnly() {
+		s.flushAPIKeyUsage()
+		s.flushQuotas()
+	}
+}
+
+// InitDB opens the database at path, creates the metadata bucket and
+// migrates records left by older versions.
+func InitDB(path string, opts Options) (*bolt.DB, error) {
+	db, err := OpenDB(path, opts)
 	if err != nil {
-		log.Fatalf("Failed to initialize the database\n%v", err)
+		return nil, fmt.Errorf("opening the database: %v", err)
 	}
+	if err := initDB(db, opts); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return db, nil
+}
+
+func initDB(db *bolt.DB, opts Options) error {
 	list, err := ListBuckets(db)
 	if err != nil {
-		log.Fatalf("Failed to list buckets in initialization\n%v", err)
+		return fmt.Errorf("listing buckets: %v", err)
 	}
-	for _, v := range list {
-		if v == metadataBucket {
-			return nil
+	if !slices.Contains(list, metadataBucket) {
+		if opts.ReadOnly {
+			return errors.New("metadata bucket missing and the database is opened read-only")
+		}
+		if err := CreateBucket(db, metadataBucket); err != nil {
+			return fmt.Errorf("creating the metadata bucket: %v", err)
 		}
 	}
-	if err := CreateBucket(db, metadataBucket); err != nil {
-		log.Fatalf("Failed to create metadata bucket in initialization\n%v", err)
+
+	if !opts.ReadOnly {
+		n, err := MigrateAPIKeys(db)
+		if err != nil {
+			return fmt.Errorf("migrating api keys: %v", err)
+		}
+		if n > 0 {
+			log.Printf("Migrated %d API keys to hashed storage", n)
+		}
+
+		if ok, err := MigrateAdminCredential(db); err != nil {
+			return fmt.Errorf("migrating admin credential: %v", err)
+		} else if ok {
+			log.Printf("Moved the admin credential to the user bucket")
+		}
 	}
 	return nil
 }
+
+// CloseDB commits queued group writes, syncs when running with NoSync and
+// closes db. Run must have returned.
+func CloseDB(db *bolt.DB) error {
+	stopGroupWriter(db)
+	if db.NoSync && !db.IsReadOnly() {
+		if err := db.Sync(); err != nil {
+			log.Printf("Final sync failed: %v", err)
+		}
+	}
+	return db.Close()
+}
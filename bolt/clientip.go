@@ -0,0 +1,116 @@
+package bolt
+
+import (
+	"errors"
+	"fmt"
+	"net/netip"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// ---------------- Client IP & Allowlists ----------------
+//
+// Behind a reverse proxy the peer address is the proxy's. When the peer is
+// one of ProxyConfig.Trusted, the client address is taken from the proxy
+// header (X-Forwarded-For by default), read from the right and skipping
+// further trusted proxies, so a client cannot spoof it by sending the
+// header itself.
+
+// ErrFooIPNotAllowed is returned (wrapped together with ErrFooForbidden) by
+// auth when an API key is used from outside its AllowedCIDRs.
+var ErrFooIPNotAllowed = errors.New("client IP not allowed")
+
+// parsePrefixes parses CIDRs; a bare address is taken as a single host.
+func parsePrefixes(list []string) ([]netip.Prefix, error) {
+	out := make([]netip.Prefix, 0, len(list))
+	for _, s := range list {
+		s = strings.TrimSpace(s)
+		if !strings.Contains(s, "/") {
+			addr, err := netip.ParseAddr(s)
+			if err != nil {
+				return nil, fmt.Errorf("invalid IP or CIDR %q", s)
+			}
+			addr = addr.Unmap()
+			out = append(out, netip.PrefixFrom(addr, addr.BitLen()))
+			continue
+		}
+		p, err := netip.ParsePrefix(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid IP or CIDR %q", s)
+		}
+		if p.Addr().Is4In6() {
+			p = netip.PrefixFrom(p.Addr().Unmap(), p.Bits()-96)
+		}
+		out = append(out, p.Masked())
+	}
+	return out, nil
+}
+
+// normalizeCIDRs validates an allowlist and returns it in canonical form,
+// e.g. "10.1.2.3/8" becomes "10.0.0.0/8" and "192.0.2.7" "192.0.2.7/32".
+func normalizeCIDRs(list []string) ([]string, error) {
+	prefixes, err := parsePrefixes(list)
+	if err != nil {
+		return nil, err
+	}
+	if len(prefixes) == 0 {
+		return nil, nil
+	}
+	out := make([]string, len(prefixes))
+	for i, p := range prefixes {
+		out[i] = p.String()
+	}
+	return out, nil
+}
+
+func containsAddr(prefixes []netip.Prefix, addr netip.Addr) bool {
+	for _, p := range prefixes {
+		if p.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// clientIP returns the address of the client that made the request.
+func clientIP(c *fiber.Ctx) string {
+	ip, ok := netip.AddrFromSlice(c.Context().RemoteIP())
+	if !ok {
+		return c.IP()
+	}
+	ip = ip.Unmap()
+	srv := serverOf(c)
+	if len(srv.trustedProxies) == 0 || !containsAddr(srv.trustedProxies, ip) {
+		return ip.String()
+	}
+	hops := strings.Split(c.Get(srv.Proxy.Header), ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop, err := netip.ParseAddr(strings.TrimSpace(hops[i]))
+		if err != nil {
+			// 无法解析的部分不可信，停在最后一个可信的代理
+			break
+		}
+		ip = hop.Unmap()
+		if !containsAddr(srv.trustedProxies, ip) {
+			break
+		}
+	}
+	return ip.String()
+}
+
+// ipAllowed reports whether ip is in allowed; an empty list allows any IP.
+func ipAllowed(allowed []string, ip string) bool {
+	if len(allowed) == 0 {
+		return true
+	}
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return false
+	}
+	prefixes, err := parsePrefixes(allowed)
+	if err != nil {
+		return false
+	}
+	return containsAddr(prefixes, addr.Unmap())
+}
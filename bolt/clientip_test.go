@@ -0,0 +1,105 @@
+package bolt
+
+import (
+	"errors"
+	"net/http/httptest"
+	"slices"
+	"testing"
+
+	"github.com/valyala/fasthttp"
+)
+
+func TestNormalizeCIDRs(t *testing.T) {
+	tests := []struct {
+		in      []string
+		want    []string
+		wantErr bool
+	}{
+		{in: nil, want: nil},
+		{in: []string{"10.1.2.3/8"}, want: []string{"10.0.0.0/8"}},
+		{in: []string{"192.0.2.7"}, want: []string{"192.0.2.7/32"}},
+		{in: []string{" 2001:db8::1 "}, want: []string{"2001:db8::1/128"}},
+		{in: []string{"2001:db8:1::/32"}, want: []string{"2001:db8::/32"}},
+		{in: []string{"::ffff:192.0.2.7"}, want: []string{"192.0.2.7/32"}},
+		{in: []string{"::ffff:10.0.0.0/104"}, want: []string{"10.0.0.0/8"}},
+		{in: []string{"10.0.0.0/8", "192.0.2.7"}, want: []string{"10.0.0.0/8", "192.0.2.7/32"}},
+		{in: []string{"10.0.0.0/33"}, wantErr: true},
+		{in: []string{"example.com"}, wantErr: true},
+		{in: []string{""}, wantErr: true},
+		{in: []string{"10.0.0.0/8", "10.0.0.0/"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := normalizeCIDRs(tt.in)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("normalizeCIDRs(%q) error = %v, wantErr %v", tt.in, err, tt.wantErr)
+			continue
+		}
+		if !slices.Equal(got, tt.want) {
+			t.Errorf("normalizeCIDRs(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+// TestClientIPAllowlist checks which address an API key's allowlist is
+// matched against, with and without trusted proxies in front.
+func TestClientIPAllowlist(t *testing.T) {
+	app, srv := newTestApp(t, func(cfg *Config) {
+		cfg.Proxy.Trusted = []string{"10.0.0.0/8", "192.0.2.1"}
+	})
+	token := newTestAPIKey(t, srv.db, APIKey{
+		Scopes:       []string{"read:*"},
+		AllowedCIDRs: []string{"203.0.113.0/24", "2001:db8::/32"},
+	})
+
+	tests := []struct {
+		name    string
+		remote  string
+		xff     string
+		allowed bool
+	}{
+		{"direct", "203.0.113.5", "", true},
+		{"direct IPv6", "2001:db8::1", "", true},
+		{"direct, outside", "198.51.100.7", "", false},
+		{"header from an untrusted peer", "198.51.100.7", "203.0.113.5", false},
+		{"trusted proxy", "10.1.1.1", "203.0.113.5", true},
+		{"trusted proxy, bare address", "192.0.2.1", "203.0.113.5", true},
+		{"trusted proxy, mapped address", "10.1.1.1", "::ffff:203.0.113.9", true},
+		{"trusted proxy without header", "10.1.1.1", "", false},
+		{"two trusted proxies", "10.1.1.1", "203.0.113.5, 10.2.2.2", true},
+		{"spoofed left part", "10.1.1.1", "203.0.113.5, 198.51.100.7", false},
+		{"spoofed behind two proxies", "10.1.1.1", "203.0.113.5,198.51.100.7,10.2.2.2", false},
+		{"unparsable hop", "10.1.1.1", "203.0.113.5, junk", false},
+		{"only trusted hops", "10.1.1.1", "10.3.3.3", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var req fasthttp.Request
+			req.SetRequestURI("/bucket")
+			req.Header.Set("Authorization", token)
+			if tt.xff != "" {
+				req.Header.Set("X-Forwarded-For", tt.xff)
+			}
+			_, err := authenticateFrom(app, srv, &req, tt.remote)
+			if tt.allowed {
+				if err != nil {
+					t.Errorf("err = %v, want allowed", err)
+				}
+				return
+			}
+			if !errors.Is(err, ErrFooIPNotAllowed) || !errors.Is(err, ErrFooForbidden) {
+				t.Errorf("err = %v, want ErrFooIPNotAllowed and ErrFooForbidden", err)
+			}
+		})
+	}
+
+	// 通过 HTTP 请求时返回 403
+	req := httptest.NewRequest("GET", "/bucket", nil)
+	req.Header.Set("Authorization", token)
+	resp, err := app.Test(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != 403 {
+		t.Errorf("status = %d, want 403", resp.StatusCode)
+	}
+}
@@ -0,0 +1,566 @@
+package bolt
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"maps"
+	"net/url"
+	"os"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	str2duration "github.com/xhit/go-str2duration/v2"
+	"gopkg.in/yaml.v3"
+)
+
+// ---------------- Config ----------------
+//
+// Precedence (later wins): built-in defaults < config file < BOLTBASE_* environment
+// variables < command line flags. The config file is given with -config or
+// BOLTBASE_CONFIG.
+
+type Config struct {
+	Name       string `yaml:"name"`
+	Addr       string `yaml:"addr"`
+	DBPath     string `yaml:"dbPath"`
+	ExportPath string `yaml:"exportPath"`
+	BodyLimit  int    `yaml:"bodyLimit"`
+
+	ShutdownTimeout time.Duration `yaml:"shutdownTimeout"`
+	Maintenance     bool          `yaml:"maintenance"` // start with readiness failing
+
+	DB    Options     `yaml:"db"`
+	CORS  CORSConfig  `yaml:"cors"`
+	Log   LogConfig   `yaml:"log"`
+	TLS   TLSConfig   `yaml:"tls"`
+	Unix  UnixConfig  `yaml:"unix"`
+	Auth  AuthConfig  `yaml:"auth"`
+	Audit AuditConfig `yaml:"audit"`
+	Proxy ProxyConfig `yaml:"proxy"`
+
+	RateLimit Limits `yaml:"rateLimit"` // defaults for every actor, see ratelimit.go
+}
+
+type CORSConfig struct {
+	CORSPolicy `yaml:",inline"`
+
+	// Routes overrides the policy for requests whose path starts with one of
+	// the route's paths, e.g. public read access to some buckets. The longest
+	// matching path wins.
+	Routes []CORSRoute `yaml:"routes"`
+}
+
+type CORSPolicy struct {
+	AllowOrigins     []string `yaml:"allowOrigins"` // empty = no cross-origin access, "*" = any origin
+	AllowMethods     string   `yaml:"allowMethods"`
+	AllowHeaders     string   `yaml:"allowHeaders"`
+	AllowCredentials bool     `yaml:"allowCredentials"`
+	MaxAge           int      `yaml:"maxAge"` // seconds browsers may cache a preflight response
+}
+
+// CORSRoute is a per-path CORS policy. Empty methods/headers are inherited
+// from the top-level policy, origins and credentials are not.
+type CORSRoute struct {
+	Paths      []string `yaml:"paths"`
+	CORSPolicy `yaml:",inline"`
+}
+
+type LogConfig struct {
+	Disable bool   `yaml:"disable"`
+	Format  string `yaml:"format"` // fiber logger format, empty = default
+	File    string `yaml:"file"`   // append logs to this file instead of stdout
+}
+
+type TLSConfig struct {
+	CertFile        string   `yaml:"certFile"`
+	KeyFile         string   `yaml:"keyFile"`
+	SelfSigned      bool     `yaml:"selfSigned"`      // generate an in-memory cert when no certFile is given (dev only)
+	SelfSignedHosts []string `yaml:"selfSignedHosts"` // DNS names / IPs for the self-signed cert
+	ClientCAFile    string   `yaml:"clientCAFile"`    // CA bundle used to verify client certificates
+	ClientAuth      string   `yaml:"clientAuth"`      // none, request (verify if given) or require
+
+	// ClientRoles maps a client certificate common name or full subject to
+	// "admin" or "apikey".
+	ClientRoles map[string]string `yaml:"clientRoles"`
+}
+
+type UnixConfig struct {
+	Path  string `yaml:"path"`  // unix socket to listen on, empty = none
+	Mode  string `yaml:"mode"`  // octal file mode, e.g. "0660"
+	Owner string `yaml:"owner"` // user name or uid
+	Group string `yaml:"group"` // group name or gid
+
+	// AdminPeers lists users (names or uids) whose processes are treated as
+	// admin when they connect over the socket, "*" trusts every local caller.
+	AdminPeers []string `yaml:"adminPeers"`
+}
+
+// ProxyConfig tells which peers are reverse proxies whose client address
+// header is believed, see clientip.go.
+type ProxyConfig struct {
+	Trusted []string `yaml:"trusted"` // IPs or CIDRs of trusted proxies, empty = use the peer address
+	Header  string   `yaml:"header"`  // header carrying the client address, e.g. X-Forwarded-For
+}
+
+type AuditConfig struct {
+	Retention time.Duration `yaml:"retention"` // 0 keeps entries forever
+}
+
+type AuthConfig struct {
+	AccessTokenTTL  time.Duration `yaml:"accessTokenTTL"`  // lifetime of bearer tokens from POST /auth/login
+	RefreshTokenTTL time.Duration `yaml:"refreshTokenTTL"` // lifetime of a login session
+	SignatureWindow time.Duration `yaml:"signatureWindow"` // how far the timestamp of a signed request may be off
+
+	Lockout LockoutConfig `yaml:"lockout"`
+}
+
+// LockoutConfig throttles repeated authentication failures, see lockout.go.
+type LockoutConfig struct {
+	Threshold   int           `yaml:"threshold"`   // failures before the first lockout, 0 = never lock
+	Duration    time.Duration `yaml:"duration"`    // first lockout, doubled on every further failure
+	MaxDuration time.Duration `yaml:"maxDuration"` // longest lockout
+	Reset       time.Duration `yaml:"reset"`       // failures are forgotten after this long without one
+}
+
+func (t TLSConfig) Enabled() bool {
+	return t.CertFile != "" || t.SelfSigned
+}
+
+func DefaultConfig() Config {
+	return Config{
+		Name:       "Boltbase v2.0",
+		Addr:       ":5090",
+		DBPath:     "./Boltbase.db",
+		ExportPath: "./Boltbase.json",
+		BodyLimit:  4 * 1024 * 1024,
+
+		ShutdownTimeout: 30 * time.Second,
+
+		DB: DefaultOptions,
+		Auth: AuthConfig{
+			AccessTokenTTL:  15 * time.Minute,
+			RefreshTokenTTL: 7 * 24 * time.Hour,
+			SignatureWindow: 5 * time.Minute,
+			Lockout: LockoutConfig{
+				Threshold:   5,
+				Duration:    30 * time.Second,
+				MaxDuration: time.Hour,
+				Reset:       time.Hour,
+			},
+		},
+		Audit: AuditConfig{Retention: 90 * 24 * time.Hour},
+		Proxy: ProxyConfig{Header: "X-Forwarded-For"},
+		CORS: CORSConfig{CORSPolicy: CORSPolicy{
+			AllowMethods: "GET, POST, HEAD, PUT, DELETE, PATCH",
+			AllowHeaders: "Origin, Content-Type, Accept, Authorization, session_token, X-Requested-With, X-Session-Token, X-API-KEY, csrf-token, X-Boltbase-Key, X-Boltbase-Timestamp, X-Boltbase-Nonce, X-Boltbase-Signature",
+		}},
+	}
+}
+
+type setting struct {
+	name   string // flag name, the env var is BOLTBASE_<NAME> with '-' as '_'
+	usage  string
+	isBool bool
+	set    func(c *Config, v string) error
+}
+
+var settings = []setting{
+	{name: "name", usage: "application name", set: setString(func(c *Config) *string { return &c.Name })},
+	{name: "addr", usage: "TCP listen address, empty = no TCP listener", set: setString(func(c *Config) *string { return &c.Addr })},
+	{name: "db-path", usage: "path of the bolt database file", set: setString(func(c *Config) *string { return &c.DBPath })},
+	{name: "export-path", usage: "file written by POST /export", set: setString(func(c *Config) *string { return &c.ExportPath })},
+	{name: "body-limit", usage: "max request body size in bytes", set: setInt(func(c *Config) *int { return &c.BodyLimit })},
+	{name: "maintenance", usage: "start in maintenance mode (readiness fails)", isBool: true, set: setBool(func(c *Config) *bool { return &c.Maintenance })},
+	{name: "shutdown-timeout", usage: "how long to wait for in-flight requests on SIGINT/SIGTERM", set: setDuration(func(c *Config) *time.Duration { return &c.ShutdownTimeout })},
+
+	{name: "db-timeout", usage: "how long to wait for the database file lock", set: setDuration(func(c *Config) *time.Duration { return &c.DB.Timeout })},
+	{name: "db-read-only", usage: "open the database read-only", isBool: true, set: setBool(func(c *Config) *bool { return &c.DB.ReadOnly })},
+	{name: "db-no-sync", usage: "do not fsync on commit", isBool: true, set: setBool(func(c *Config) *bool { return &c.DB.NoSync })},
+	{name: "db-no-grow-sync", usage: "do not fsync when the file grows", isBool: true, set: setBool(func(c *Config) *bool { return &c.DB.NoGrowSync })},
+	{name: "db-sync-interval", usage: "with db-no-sync, fsync in the background this often", set: setDuration(func(c *Config) *time.Duration { return &c.DB.SyncInterval })},
+	{name: "db-initial-mmap-size", usage: "initial mmap size in bytes", set: setInt(func(c *Config) *int { return &c.DB.InitialMmapSize })},
+	{name: "db-mmap-flags", usage: "extra mmap flags", set: setInt(func(c *Config) *int { return &c.DB.MmapFlags })},
+
+	{name: "cors-allow-origins", usage: "comma separated allowed origins, empty = same-origin only, * = any", set: setList(func(c *Config) *[]string { return &c.CORS.AllowOrigins })},
+	{name: "cors-allow-methods", usage: "comma separated allowed methods", set: setString(func(c *Config) *string { return &c.CORS.AllowMethods })},
+	{name: "cors-allow-headers", usage: "comma separated allowed headers", set: setString(func(c *Config) *string { return &c.CORS.AllowHeaders })},
+	{name: "cors-allow-credentials", usage: "allow credentialed cross-origin requests", isBool: true, set: setBool(func(c *Config) *bool { return &c.CORS.AllowCredentials })},
+	{name: "cors-max-age", usage: "seconds browsers may cache a preflight response", set: setInt(func(c *Config) *int { return &c.CORS.MaxAge })},
+
+	{name: "unix-path", usage: "also listen on this unix socket", set: setString(func(c *Config) *string { return &c.Unix.Path })},
+	{name: "unix-mode", usage: "octal file mode of the unix socket", set: setString(func(c *Config) *string { return &c.Unix.Mode })},
+	{name: "unix-owner", usage: "owner (user name or uid) of the unix socket", set: setString(func(c *Config) *string { return &c.Unix.Owner })},
+	{name: "unix-group", usage: "group (name or gid) of the unix socket", set: setString(func(c *Config) *string { return &c.Unix.Group })},
+	{name: "unix-admin-peers", usage: "comma separated users trusted as admin over the unix socket, * = all", set: setList(func(c *Config) *[]string { return &c.Unix.AdminPeers })},
+
+	{name: "auth-access-token-ttl", usage: "lifetime of access tokens issued by /auth/login", set: setDuration(func(c *Config) *time.Duration { return &c.Auth.AccessTokenTTL })},
+	{name: "auth-refresh-token-ttl", usage: "lifetime of refresh tokens (login sessions)", set: setDuration(func(c *Config) *time.Duration { return &c.Auth.RefreshTokenTTL })},
+	{name: "auth-signature-window", usage: "accepted clock skew of signed requests", set: setDuration(func(c *Config) *time.Duration { return &c.Auth.SignatureWindow })},
+	{name: "rate-limit-read", usage: "default read rate per actor as perSecond[:burst], 0 = unlimited", set: setRate(func(c *Config) **Rate { return &c.RateLimit.Read })},
+	{name: "rate-limit-write", usage: "default write rate per actor as perSecond[:burst], 0 = unlimited", set: setRate(func(c *Config) **Rate { return &c.RateLimit.Write })},
+	{name: "rate-limit-scan", usage: "default scan/export rate per actor as perSecond[:burst], 0 = unlimited", set: setRate(func(c *Config) **Rate { return &c.RateLimit.Scan })},
+	{name: "daily-quota", usage: "default requests per actor per UTC day, 0 = unlimited", set: func(c *Config, v string) error {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			return err
+		}
+		c.RateLimit.DailyQuota = &n
+		return nil
+	}},
+	{name: "auth-lockout-threshold", usage: "failed authentications per IP or username before a lockout, 0 = never lock", set: setInt(func(c *Config) *int { return &c.Auth.Lockout.Threshold })},
+	{name: "auth-lockout-duration", usage: "first lockout, doubled on every further failure", set: setDuration(func(c *Config) *time.Duration { return &c.Auth.Lockout.Duration })},
+	{name: "auth-lockout-max-duration", usage: "longest lockout", set: setDuration(func(c *Config) *time.Duration { return &c.Auth.Lockout.MaxDuration })},
+	{name: "auth-lockout-reset", usage: "forget failures after this long without one", set: setDuration(func(c *Config) *time.Duration { return &c.Auth.Lockout.Reset })},
+	{name: "audit-retention", usage: "how long audit log entries are kept, 0 = forever", set: setDuration(func(c *Config) *time.Duration { return &c.Audit.Retention })},
+
+	{name: "proxy-trusted", usage: "comma separated IPs or CIDRs of reverse proxies whose client address header is trusted", set: setList(func(c *Config) *[]string { return &c.Proxy.Trusted })},
+	{name: "proxy-header", usage: "header a trusted proxy puts the client address in", set: setString(func(c *Config) *string { return &c.Proxy.Header })},
+
+	{name: "log-disable", usage: "disable the access log", isBool: true, set: setBool(func(c *Config) *bool { return &c.Log.Disable })},
+	{name: "log-format", usage: "access log format", set: setString(func(c *Config) *string { return &c.Log.Format })},
+	{name: "log-file", usage: "append logs to this file instead of stdout", set: setString(func(c *Config) *string { return &c.Log.File })},
+
+	{name: "tls-cert", usage: "TLS certificate file", set: setString(func(c *Config) *string { return &c.TLS.CertFile })},
+	{name: "tls-key", usage: "TLS private key file", set: setString(func(c *Config) *string { return &c.TLS.KeyFile })},
+	{name: "tls-self-signed", usage: "serve HTTPS with a generated self-signed certificate (dev only)", isBool: true, set: setBool(func(c *Config) *bool { return &c.TLS.SelfSigned })},
+	{name: "tls-self-signed-hosts", usage: "comma separated hosts for the self-signed certificate", set: setList(func(c *Config) *[]string { return &c.TLS.SelfSignedHosts })},
+	{name: "tls-client-ca", usage: "CA bundle for verifying client certificates", set: setString(func(c *Config) *string { return &c.TLS.ClientCAFile })},
+	{name: "tls-client-auth", usage: "client certificate policy: none, request or require", set: setString(func(c *Config) *string { return &c.TLS.ClientAuth })},
+	{name: "tls-client-roles", usage: "comma separated subject=role pairs, role is admin or apikey", set: setMap(func(c *Config) *map[string]string { return &c.TLS.ClientRoles })},
+}
+
+func (s setting) env() string {
+	return "BOLTBASE_" + strings.ToUpper(strings.ReplaceAll(s.name, "-", "_"))
+}
+
+// LoadConfig builds the configuration from defaults, the config file, the
+// environment and the command line args (without the program name).
+func LoadConfig(args []string) (Config, error) {
+	cfg := DefaultConfig()
+
+	fs := flag.NewFlagSet("boltbase", flag.ContinueOnError)
+	configPath := fs.String("config", os.Getenv("BOLTBASE_CONFIG"), "YAML config file (env BOLTBASE_CONFIG)")
+	flagVals := make(map[string]string)
+	for _, s := range settings {
+		name := s.name
+		usage := fmt.Sprintf("%s (env %s)", s.usage, s.env())
+		record := func(v string) error {
+			flagVals[name] = v
+			return nil
+		}
+		if s.isBool {
+			fs.BoolFunc(name, usage, record)
+		} else {
+			fs.Func(name, usage, record)
+		}
+	}
+	if err := fs.Parse(args); err != nil {
+		return cfg, err
+	}
+
+	if *configPath != "" {
+		data, err := os.ReadFile(*configPath)
+		if err != nil {
+			return cfg, err
+		}
+		if err := decodeConfigFile(data, &cfg); err != nil {
+			return cfg, fmt.Errorf("%s: %v", *configPath, err)
+		}
+	}
+
+	for _, s := range settings {
+		if v, ok := os.LookupEnv(s.env()); ok {
+			if err := s.set(&cfg, v); err != nil {
+				return cfg, fmt.Errorf("%s: %v", s.env(), err)
+			}
+		}
+	}
+	for _, s := range settings {
+		if v, ok := flagVals[s.name]; ok {
+			if err := s.set(&cfg, v); err != nil {
+				return cfg, fmt.Errorf("-%s: %v", s.name, err)
+			}
+		}
+	}
+
+	return cfg, cfg.validate()
+}
+
+func (c Config) validate() error {
+	if c.Addr == "" && c.Unix.Path == "" {
+		return errors.New("nothing to listen on: set addr and/or unix.path")
+	}
+	if (c.TLS.CertFile == "") != (c.TLS.KeyFile == "") {
+		return errors.New("tls: certFile and keyFile must be set together")
+	}
+	// unix socket 上总是明文 HTTP
+	if c.TLS.Enabled() && c.Addr == "" {
+		return errors.New("tls: only applies to the TCP listener, but addr is empty")
+	}
+	switch c.TLS.ClientAuth {
+	case "", "none", "request", "require":
+	default:
+		return errors.New("tls: clientAuth must be one of none, request, require")
+	}
+	if c.TLS.ClientAuth != "" && c.TLS.ClientAuth != "none" {
+		if c.TLS.ClientCAFile == "" {
+			return errors.New("tls: clientAuth needs clientCAFile")
+		}
+		if !c.TLS.Enabled() {
+			return errors.New("tls: clientAuth needs certFile/keyFile or selfSigned")
+		}
+	}
+	for subject, role := range c.TLS.ClientRoles {
+		if role != "admin" && role != "apikey" {
+			return fmt.Errorf("tls: role of %q must be admin or apikey", subject)
+		}
+	}
+	if err := c.CORS.validate("cors"); err != nil {
+		return err
+	}
+	for i, r := range c.CORS.Routes {
+		name := fmt.Sprintf("cors.routes[%d]", i)
+		if len(r.Paths) == 0 {
+			return errors.New(name + ": paths cannot be empty")
+		}
+		for _, p := range r.Paths {
+			if !strings.HasPrefix(p, "/") {
+				return fmt.Errorf("%s: path %q must start with '/'", name, p)
+			}
+		}
+		if err := r.validate(name); err != nil {
+			return err
+		}
+	}
+	if c.Auth.AccessTokenTTL <= 0 || c.Auth.RefreshTokenTTL <= 0 {
+		return errors.New("auth: token lifetimes must be >0")
+	}
+	if c.Auth.SignatureWindow <= 0 {
+		return errors.New("auth: signatureWindow must be >0")
+	}
+	if l := c.Auth.Lockout; l.Threshold < 0 || l.Threshold > 0 && (l.Duration <= 0 || l.MaxDuration < l.Duration || l.Reset <= 0) {
+		return errors.New("auth.lockout: threshold must be >=0 and durations >0 with maxDuration >= duration")
+	}
+	if err := c.RateLimit.validate(); err != nil {
+		return fmt.Errorf("rateLimit: %v", err)
+	}
+	if c.Audit.Retention < 0 {
+		return errors.New("audit: retention must be >=0")
+	}
+	if _, err := parsePrefixes(c.Proxy.Trusted); err != nil {
+		return fmt.Errorf("proxy.trusted: %v", err)
+	}
+	if len(c.Proxy.Trusted) > 0 && c.Proxy.Header == "" {
+		return errors.New("proxy: header is required with trusted proxies")
+	}
+	if c.BodyLimit <= 0 {
+		return errors.New("bodyLimit must be >0")
+	}
+	return nil
+}
+
+func (p CORSPolicy) validate(name string) error {
+	for _, o := range p.AllowOrigins {
+		if o == "*" {
+			if len(p.AllowOrigins) > 1 {
+				return errors.New(name + ": '*' cannot be combined with other origins")
+			}
+			if p.AllowCredentials {
+				return errors.New(name + ": allowCredentials cannot be used with the '*' origin")
+			}
+			continue
+		}
+		// fiber accepts a single "*." wildcard label, e.g. https://*.example.com
+		u, err := url.Parse(strings.Replace(o, "://*.", "://", 1))
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" || (u.Path != "" && u.Path != "/") {
+			return fmt.Errorf("%s: invalid origin %q, want scheme://host[:port]", name, o)
+		}
+	}
+	if p.MaxAge < 0 {
+		return errors.New(name + ": maxAge must be >=0")
+	}
+	return nil
+}
+
+func setString(field func(*Config) *string) func(*Config, string) error {
+	return func(c *Config, v string) error {
+		*field(c) = v
+		return nil
+	}
+}
+
+func setBool(field func(*Config) *bool) func(*Config, string) error {
+	return func(c *Config, v string) error {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return err
+		}
+		*field(c) = b
+		return nil
+	}
+}
+
+func setInt(field func(*Config) *int) func(*Config, string) error {
+	return func(c *Config, v string) error {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			return err
+		}
+		*field(c) = n
+		return nil
+	}
+}
+
+func setDuration(field func(*Config) *time.Duration) func(*Config, string) error {
+	return func(c *Config, v string) error {
+		d, err := str2duration.ParseDuration(v)
+		if err != nil {
+			return err
+		}
+		*field(c) = d
+		return nil
+	}
+}
+
+// decodeConfigFile decodes a YAML config file over cfg. Durations are parsed
+// with str2duration like the flags and environment variables, so "7d" works
+// here too, and keys cfg has no field for are rejected.
+func decodeConfigFile(data []byte, cfg *Config) error {
+	var doc yaml.Node
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return err
+	}
+	if len(doc.Content) == 0 {
+		return nil // empty file
+	}
+	if err := prepareYAML(doc.Content[0], reflect.TypeFor[Config]()); err != nil {
+		return err
+	}
+	return doc.Decode(cfg)
+}
+
+var durationType = reflect.TypeFor[time.Duration]()
+
+// prepareYAML walks node, which is about to be decoded into a t. It rewrites
+// duration strings to Go syntax and, since Node.Decode cannot, does the
+// KnownFields check.
+func prepareYAML(node *yaml.Node, t reflect.Type) error {
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	switch node.Kind {
+	case yaml.AliasNode:
+		return prepareYAML(node.Alias, t)
+	case yaml.ScalarNode:
+		if t == durationType && node.ShortTag() == "!!str" {
+			d, err := str2duration.ParseDuration(node.Value)
+			if err != nil {
+				return fmt.Errorf("line %d: %v", node.Line, err)
+			}
+			node.Value = d.String()
+		}
+	case yaml.SequenceNode:
+		if t.Kind() == reflect.Slice || t.Kind() == reflect.Array {
+			for _, n := range node.Content {
+				if err := prepareYAML(n, t.Elem()); err != nil {
+					return err
+				}
+			}
+		}
+	case yaml.MappingNode:
+		var fields map[string]reflect.Type
+		if t.Kind() == reflect.Struct {
+			fields = yamlFields(t)
+		}
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			key, value := node.Content[i], node.Content[i+1]
+			var vt reflect.Type
+			switch {
+			case key.ShortTag() == "!!merge":
+				vt = t
+			case t.Kind() == reflect.Map:
+				vt = t.Elem()
+			case fields != nil:
+				var ok bool
+				if vt, ok = fields[key.Value]; !ok {
+					return fmt.Errorf("line %d: field %s not found in type %s", key.Line, key.Value, t)
+				}
+			default:
+				continue
+			}
+			if err := prepareYAML(value, vt); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// yamlFields maps the keys yaml.v3 accepts for struct t to the field types.
+func yamlFields(t reflect.Type) map[string]reflect.Type {
+	fields := make(map[string]reflect.Type)
+	for i := range t.NumField() {
+		f := t.Field(i)
+		if !f.IsExported() {
+			continue
+		}
+		name, opts, _ := strings.Cut(f.Tag.Get("yaml"), ",")
+		switch {
+		case name == "-":
+			continue
+		case slices.Contains(strings.Split(opts, ","), "inline"):
+			maps.Copy(fields, yamlFields(f.Type))
+			continue
+		case name == "":
+			name = strings.ToLower(f.Name)
+		}
+		fields[name] = f.Type
+	}
+	return fields
+}
+
+func setRate(field func(*Config) **Rate) func(*Config, string) error {
+	return func(c *Config, v string) error {
+		r, err := parseRate(v)
+		if err != nil {
+			return err
+		}
+		*field(c) = &r
+		return nil
+	}
+}
+
+func setList(field func(*Config) *[]string) func(*Config, string) error {
+	return func(c *Config, v string) error {
+		var out []string
+		for _, item := range strings.Split(v, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				out = append(out, item)
+			}
+		}
+		*field(c) = out
+		return nil
+	}
+}
+
+func setMap(field func(*Config) *map[string]string) func(*Config, string) error {
+	return func(c *Config, v string) error {
+		out := make(map[string]string)
+		for _, item := range strings.Split(v, ",") {
+			if item = strings.TrimSpace(item); item == "" {
+				continue
+			}
+			k, val, ok := strings.Cut(item, "=")
+			if !ok {
+				return fmt.Errorf("%q is not key=value", item)
+			}
+			out[strings.TrimSpace(k)] = strings.TrimSpace(val)
+		}
+		*field(c) = out
+		return nil
+	}
+}
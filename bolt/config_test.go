@@ -0,0 +1,77 @@
+package bolt
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func loadConfigFile(t *testing.T, yaml string) (Config, error) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "boltbase.yaml")
+	if err := os.WriteFile(path, []byte(yaml), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return LoadConfig([]string{"-config", path})
+}
+
+func TestConfigFileDurations(t *testing.T) {
+	cfg, err := loadConfigFile(t, `
+db:
+  syncInterval: 1m30s
+audit:
+  retention: 1w
+auth:
+  refreshTokenTTL: 7d
+  lockout:
+    duration: "45s"
+    maxDuration: 1d12h
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range []struct {
+		name      string
+		got, want time.Duration
+	}{
+		{"db.syncInterval", cfg.DB.SyncInterval, 90 * time.Second},
+		{"audit.retention", cfg.Audit.Retention, 7 * 24 * time.Hour},
+		{"auth.refreshTokenTTL", cfg.Auth.RefreshTokenTTL, 7 * 24 * time.Hour},
+		{"auth.lockout.duration", cfg.Auth.Lockout.Duration, 45 * time.Second},
+		{"auth.lockout.maxDuration", cfg.Auth.Lockout.MaxDuration, 36 * time.Hour},
+	} {
+		if tt.got != tt.want {
+			t.Errorf("%s = %v, want %v", tt.name, tt.got, tt.want)
+		}
+	}
+	if cfg.Auth.AccessTokenTTL != DefaultConfig().Auth.AccessTokenTTL {
+		t.Errorf("auth.accessTokenTTL = %v, want the default", cfg.Auth.AccessTokenTTL)
+	}
+}
+
+func TestConfigFileErrors(t *testing.T) {
+	for _, tt := range []struct {
+		yaml, want string
+	}{
+		{"auth:\n  refreshTokenTTL: soon\n", "line 2"},
+		{"auth:\n  lockout:\n    treshold: 3\n", "line 3: field treshold not found"},
+		{"cors:\n  allowOrigins: [a]\n  routes:\n    - paths: [/x]\n      maxAge: 1\n      origin: b\n", "line 6: field origin not found"},
+	} {
+		_, err := loadConfigFile(t, tt.yaml)
+		if err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("%q: err = %v, want %q", tt.yaml, err, tt.want)
+		}
+	}
+}
+
+func TestConfigFileEmpty(t *testing.T) {
+	cfg, err := loadConfigFile(t, "# nothing\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Auth.RefreshTokenTTL != DefaultConfig().Auth.RefreshTokenTTL {
+		t.Errorf("refreshTokenTTL = %v, want the default", cfg.Auth.RefreshTokenTTL)
+	}
+}
@@ -0,0 +1,64 @@
+package bolt
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/middleware/cors"
+)
+
+// ---------------- CORS ----------------
+
+type corsRoute struct {
+	path    string
+	handler fiber.Handler
+}
+
+// corsMiddleware applies the top-level CORS policy, or the policy of the
+// longest CORSRoute path matching the request path. A policy without origins
+// adds no CORS headers at all, so browsers only allow same-origin calls.
+func corsMiddleware(cfg CORSConfig) fiber.Handler {
+	var routes []corsRoute
+	for _, r := range cfg.Routes {
+		p := r.CORSPolicy
+		if p.AllowMethods == "" {
+			p.AllowMethods = cfg.AllowMethods
+		}
+		if p.AllowHeaders == "" {
+			p.AllowHeaders = cfg.AllowHeaders
+		}
+		h := corsHandler(p)
+		for _, path := range r.Paths {
+			routes = append(routes, corsRoute{strings.TrimSuffix(path, "/"), h})
+		}
+	}
+	sort.SliceStable(routes, func(i, j int) bool {
+		return len(routes[i].path) > len(routes[j].path)
+	})
+	def := corsHandler(cfg.CORSPolicy)
+
+	return func(c *fiber.Ctx) error {
+		path := c.Path()
+		for _, r := range routes {
+			// 只按完整的路径段匹配: /kv/get/public 不匹配 /kv/get/publicity
+			if path == r.path || strings.HasPrefix(path, r.path+"/") {
+				return r.handler(c)
+			}
+		}
+		return def(c)
+	}
+}
+
+func corsHandler(p CORSPolicy) fiber.Handler {
+	if len(p.AllowOrigins) == 0 {
+		return func(c *fiber.Ctx) error { return c.Next() }
+	}
+	return cors.New(cors.Config{
+		AllowOrigins:     strings.Join(p.AllowOrigins, ","),
+		AllowMethods:     p.AllowMethods,
+		AllowHeaders:     p.AllowHeaders,
+		AllowCredentials: p.AllowCredentials,
+		MaxAge:           p.MaxAge,
+	})
+}
@@ -0,0 +1,60 @@
+package bolt
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"sync"
+	"time"
+)
+
+// ---------------- ULID ----------------
+
+const crockford = "0123456789ABCDEFGHJKMNPQRSTVWXYZ"
+
+var (
+	ulidMu   sync.Mutex
+	ulidMs   uint64
+	ulidLast [16]byte
+)
+
+// NewULID returns a ULID (48-bit millisecond timestamp + 80 random bits).
+// IDs generated within the same millisecond are monotonically increasing.
+func NewULID() (string, error) {
+	ulidMu.Lock()
+	defer ulidMu.Unlock()
+
+	ms := uint64(time.Now().UnixMilli())
+	if ms > ulidMs {
+		ulidMs = ms
+		var ts [8]byte
+		binary.BigEndian.PutUint64(ts[:], ms)
+		copy(ulidLast[:6], ts[2:])
+		if _, err := rand.Read(ulidLast[6:]); err != nil {
+			return "", err
+		}
+		return encodeULID(ulidLast), nil
+	}
+
+	// 同一毫秒内（或时钟回拨）: 随机部分 +1，保证单调递增
+	for i := 15; i >= 6; i-- {
+		ulidLast[i]++
+		if ulidLast[i] != 0 {
+			return encodeULID(ulidLast), nil
+		}
+	}
+	return "", errors.New("ulid random part overflow")
+}
+
+func encodeULID(id [16]byte) string {
+	hi := binary.BigEndian.Uint64(id[:8])
+	lo := binary.BigEndian.Uint64(id[8:])
+
+	var buf [26]byte
+	for i := 25; i >= 0; i-- {
+		buf[i] = crockford[lo&31]
+		lo = lo>>5 | hi<<59
+		hi >>= 5
+	}
+	return string(buf[:])
+}
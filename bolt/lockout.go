@@ -0,0 +1,245 @@
+package bolt
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// ---------------- Failed Login Lockout ----------------
+//
+// Failed authentications are counted per client (IP, or peer uid on the
+// unix socket) and per username. Once
+// a counter reaches LockoutConfig.Threshold the IP or username is locked
+// out for LockoutConfig.Duration, doubling with every further failure up to
+// MaxDuration. Locked requests are rejected before any credential is
+// checked. The counters live in memory only.
+
+type lockoutEntry struct {
+	Key         string    `json:"key"` // "ip:<addr>", "peer:uid=<uid>" or "user:<name>"
+	Failures    int       `json:"failures"`
+	LastFailure time.Time `json:"lastFailure"`
+	LockedUntil time.Time `json:"lockedUntil,omitzero"`
+	Lockouts    int       `json:"lockouts"` // how often the key was locked out
+}
+
+// lockoutTable is the failure tracking of one server.
+type lockoutTable struct {
+	mu      sync.Mutex
+	entries map[string]*lockoutEntry
+
+	gateMu sync.Mutex
+	gates  map[string]*passwordGate // by client key
+}
+
+func newLockoutTable() *lockoutTable {
+	return &lockoutTable{
+		entries: make(map[string]*lockoutEntry),
+		gates:   make(map[string]*passwordGate),
+	}
+}
+
+type passwordGate struct {
+	mu      sync.Mutex
+	waiting int // holders and waiters, the gate is dropped at 0
+}
+
+func userLockoutKey(username string) string { return "user:" + username }
+
+// clientLockoutKey names where a request comes from. Unix socket
+// connections have no IP (fasthttp reports 0.0.0.0 for all of them), so
+// they are told apart by the uid of the peer process.
+func clientLockoutKey(c *fiber.Ctx) string {
+	if pc, ok := c.Context().Conn().(*peerConn); ok {
+		if !pc.credOK {
+			return "peer:unknown"
+		}
+		return fmt.Sprintf("peer:uid=%d", pc.uid)
+	}
+	return "ip:" + clientIP(c)
+}
+
+// lockedFor returns how much longer the first locked key stays locked.
+func (s *server) lockedFor(keys ...string) time.Duration {
+	if s.Auth.Lockout.Threshold <= 0 {
+		return 0
+	}
+	now := time.Now()
+	s.lockouts.mu.Lock()
+	defer s.lockouts.mu.Unlock()
+	for _, key := range keys {
+		if e, ok := s.lockouts.entries[key]; ok && e.LockedUntil.After(now) {
+			return e.LockedUntil.Sub(now)
+		}
+	}
+	return 0
+}
+
+// recordAuthFailure counts a failed attempt for every key and locks the
+// keys that reached the threshold.
+func (s *server) recordAuthFailure(keys ...string) {
+	cfg := s.Auth.Lockout
+	if cfg.Threshold <= 0 {
+		return
+	}
+	now := time.Now()
+	s.lockouts.mu.Lock()
+	defer s.lockouts.mu.Unlock()
+	for _, key := range keys {
+		e, ok := s.lockouts.entries[key]
+		if !ok {
+			e = &lockoutEntry{Key: key}
+			s.lockouts.entries[key] = e
+		} else if now.Sub(e.LastFailure) > cfg.Reset {
+			e.Failures = 0
+		}
+		e.Failures++
+		e.LastFailure = now
+		if e.Failures < cfg.Threshold {
+			continue
+		}
+		d := time.Duration(float64(cfg.Duration) * math.Pow(2, float64(e.Failures-cfg.Threshold)))
+		if d > cfg.MaxDuration || d <= 0 {
+			d = cfg.MaxDuration
+		}
+		e.LockedUntil = now.Add(d)
+		e.Lockouts++
+		log.Printf("Locked out %s for %s after %d failed authentication attempts", key, d, e.Failures)
+	}
+}
+
+// clearAuthFailures forgets the failures of key after a successful login.
+func (s *server) clearAuthFailures(key string) {
+	s.lockouts.mu.Lock()
+	delete(s.lockouts.entries, key)
+	s.lockouts.mu.Unlock()
+}
+
+// listLockouts returns the tracked keys, locked ones first.
+func (s *server) listLockouts() []lockoutEntry {
+	s.lockouts.mu.Lock()
+	list := make([]lockoutEntry, 0, len(s.lockouts.entries))
+	for _, e := range s.lockouts.entries {
+		list = append(list, *e)
+	}
+	s.lockouts.mu.Unlock()
+	now := time.Now()
+	sort.Slice(list, func(i, j int) bool {
+		li, lj := list[i].LockedUntil.After(now), list[j].LockedUntil.After(now)
+		if li != lj {
+			return li
+		}
+		return list[i].Key < list[j].Key
+	})
+	return list
+}
+
+// unlock removes key, or every key when key is empty, and returns how many
+// were removed.
+func (s *server) unlock(key string) int {
+	s.lockouts.mu.Lock()
+	defer s.lockouts.mu.Unlock()
+	if key == "" {
+		n := len(s.lockouts.entries)
+		clear(s.lockouts.entries)
+		return n
+	}
+	if _, ok := s.lockouts.entries[key]; !ok {
+		return 0
+	}
+	delete(s.lockouts.entries, key)
+	return 1
+}
+
+// pruneLockouts forgets keys that are neither locked nor within the reset
+// window of their last failure.
+func (s *server) pruneLockouts() {
+	now := time.Now()
+	s.lockouts.mu.Lock()
+	defer s.lockouts.mu.Unlock()
+	for key, e := range s.lockouts.entries {
+		if !e.LockedUntil.After(now) && now.Sub(e.LastFailure) > s.Auth.Lockout.Reset {
+			delete(s.lockouts.entries, key)
+		}
+	}
+}
+
+// authLockoutKeys returns the keys a request's credentials are counted
+// under: always its client key, plus the username of Basic credentials.
+func authLockoutKeys(c *fiber.Ctx, username string) []string {
+	keys := []string{clientLockoutKey(c)}
+	if username != "" {
+		keys = append(keys, userLockoutKey(username))
+	}
+	return keys
+}
+
+// checkPasswordFrom checks Basic or login credentials sent by the request.
+// The checks of one client run one at a time, a failure is counted before
+// the next one starts, and a client that got locked out in the meantime is
+// refused without computing the hash. So no client holds more than one of
+// the argonMaxConcurrent slots, or gets more than Threshold guesses in.
+func checkPasswordFrom(c *fiber.Ctx, username, password string) (User, bool, error) {
+	s := serverOf(c)
+	keys := authLockoutKeys(c, username)
+	release := s.enterPasswordGate(keys[0])
+	defer release()
+	if s.lockedFor(keys...) > 0 {
+		return User{}, false, nil
+	}
+	u, ok, err := checkUserPassword(s.db, username, password)
+	if err == nil && !ok {
+		s.recordAuthFailure(keys...)
+	}
+	return u, ok, err
+}
+
+// enterPasswordGate waits until no other password check of client runs.
+func (s *server) enterPasswordGate(client string) (release func()) {
+	l := s.lockouts
+	l.gateMu.Lock()
+	g, ok := l.gates[client]
+	if !ok {
+		g = &passwordGate{}
+		l.gates[client] = g
+	}
+	g.waiting++
+	l.gateMu.Unlock()
+
+	g.mu.Lock()
+	return func() {
+		g.mu.Unlock()
+		l.gateMu.Lock()
+		if g.waiting--; g.waiting == 0 {
+			delete(l.gates, client)
+		}
+		l.gateMu.Unlock()
+	}
+}
+
+// lockoutMiddleware rejects requests from a locked IP or for a locked
+// username before their credentials are looked at.
+func lockoutMiddleware(c *fiber.Ctx) error {
+	// 登录页面自己处理锁定，显示错误信息而不是 JSON
+	if routeClass(c) == "" {
+		return c.Next()
+	}
+	// 受信任的本地进程不看凭证，别人猜错密码不能把它锁在外面
+	if _, ok := peerIsAdmin(c); ok {
+		return c.Next()
+	}
+	username, _, _ := parseBasicAuth(c.Get(fiber.HeaderAuthorization))
+	if d := serverOf(c).lockedFor(authLockoutKeys(c, username)...); d > 0 {
+		return lockedOut(c, d)
+	}
+	return c.Next()
+}
+
+func lockedOut(c *fiber.Ctx, d time.Duration) error {
+	return tooManyRequests(c, d, "Too many failed authentication attempts, try again later")
+}
@@ -0,0 +1,103 @@
+package bolt
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestLockoutThresholds(t *testing.T) {
+	_, srv := newTestApp(t, func(cfg *Config) {
+		cfg.Auth.Lockout = LockoutConfig{
+			Threshold:   3,
+			Duration:    time.Minute,
+			MaxDuration: 5 * time.Minute,
+			Reset:       time.Hour,
+		}
+	})
+
+	// 第 n 次失败之后的锁定时长
+	want := []time.Duration{0, 0, time.Minute, 2 * time.Minute, 4 * time.Minute, 5 * time.Minute, 5 * time.Minute}
+	for i, d := range want {
+		srv.recordAuthFailure("ip:192.0.2.1", "user:bob")
+		got := srv.lockedFor("ip:192.0.2.1")
+		if got > d || got < d-time.Second {
+			t.Errorf("after %d failures locked for %v, want %v", i+1, got, d)
+		}
+	}
+	if srv.lockedFor("ip:192.0.2.2") != 0 {
+		t.Error("an unrelated key is locked")
+	}
+	if srv.lockedFor("ip:192.0.2.2", "user:bob") == 0 {
+		t.Error("a request for a locked username is not locked")
+	}
+
+	// 超过 reset 没有新的失败就重新计数
+	srv.lockouts.mu.Lock()
+	for _, e := range srv.lockouts.entries {
+		e.LastFailure = e.LastFailure.Add(-2 * time.Hour)
+		e.LockedUntil = time.Time{}
+	}
+	srv.lockouts.mu.Unlock()
+	srv.recordAuthFailure("ip:192.0.2.1")
+	if d := srv.lockedFor("ip:192.0.2.1"); d != 0 {
+		t.Errorf("first failure after the reset window locks for %v", d)
+	}
+	srv.pruneLockouts()
+	if list := srv.listLockouts(); len(list) != 1 || list[0].Key != "ip:192.0.2.1" || list[0].Failures != 1 || list[0].Lockouts != 5 {
+		t.Errorf("after pruning: %+v, want only ip:192.0.2.1 with 1 failure and 5 past lockouts", list)
+	}
+
+	srv.Auth.Lockout.Threshold = 0
+	for range 10 {
+		srv.recordAuthFailure("ip:192.0.2.3")
+	}
+	if d := srv.lockedFor("ip:192.0.2.3"); d != 0 {
+		t.Errorf("locked for %v with lockouts disabled", d)
+	}
+}
+
+func TestLockoutRequests(t *testing.T) {
+	app, _ := newTestApp(t, func(cfg *Config) {
+		cfg.Auth.Lockout.Threshold = 3
+	})
+
+	basic := func(user, password string) *http.Request {
+		req := httptest.NewRequest("GET", "/bucket", nil)
+		req.SetBasicAuth(user, password)
+		return req
+	}
+	apiKey := func(token string) *http.Request {
+		req := httptest.NewRequest("GET", "/bucket", nil)
+		req.Header.Set("Authorization", token)
+		return req
+	}
+	steps := []struct {
+		name string
+		req  *http.Request
+		want int
+	}{
+		{"no credentials", httptest.NewRequest("GET", "/bucket", nil), 401},
+		{"wrong password 1", basic("admin", "wrong"), 401},
+		{"right password keeps the IP's count", basic("admin", testPassword), 200},
+		{"unknown api key", apiKey("bb_000000000000_x"), 401},
+		{"wrong password 2", basic("admin", "wrong"), 401},
+		{"locked, right password", basic("admin", testPassword), 429},
+		{"locked, other user", basic("someone", "x"), 429},
+		{"health is not locked", httptest.NewRequest("GET", "/health", nil), 200},
+		{"ready is not locked", httptest.NewRequest("GET", "/ready", nil), 200},
+	}
+	for _, s := range steps {
+		resp, err := app.Test(s.req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.StatusCode != s.want {
+			t.Errorf("%s: status = %d, want %d", s.name, resp.StatusCode, s.want)
+		}
+		if s.want == 429 && resp.Header.Get("Retry-After") == "" {
+			t.Errorf("%s: no Retry-After", s.name)
+		}
+	}
+}
@@ -0,0 +1,158 @@
+package bolt
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	bolt "github.com/boltdb/bolt"
+	"golang.org/x/crypto/argon2"
+)
+
+// ---------------- Password Hashing ----------------
+
+// argon2id parameters for new hashes (RFC 9106, second recommended option).
+// Existing hashes keep the parameters encoded in them.
+const (
+	argonTime    = 3
+	argonMemory  = 64 * 1024 // KiB
+	argonThreads = 4
+	argonSaltLen = 16
+	argonKeyLen  = 32
+
+	// argonMaxConcurrent bounds how many hashes are computed at once, since
+	// each one takes argonMemory. A client gets at most one of them at a
+	// time, see checkPasswordFrom.
+	argonMaxConcurrent = 4
+)
+
+// argonSlots is shared by all servers in the process: the bound is on
+// memory, not per app.
+var argonSlots = make(chan struct{}, argonMaxConcurrent)
+
+// idKey is argon2.IDKey limited to argonMaxConcurrent callers; the others
+// wait for a slot.
+func idKey(password, salt []byte, time, memory uint32, threads uint8, keyLen uint32) []byte {
+	argonSlots <- struct{}{}
+	defer func() { <-argonSlots }()
+	return argon2.IDKey(password, salt, time, memory, threads, keyLen)
+}
+
+var errBadHash = errors.New("unsupported password hash")
+
+// hashPassword returns a salted argon2id hash in PHC string format:
+// $argon2id$v=19$m=65536,t=3,p=4$<salt>$<hash>
+func hashPassword(password string) (string, error) {
+	salt := make([]byte, argonSaltLen)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	key := idKey([]byte(password), salt, argonTime, argonMemory, argonThreads, argonKeyLen)
+	return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s",
+		argon2.Version, argonMemory, argonTime, argonThreads,
+		base64.RawStdEncoding.EncodeToString(salt),
+		base64.RawStdEncoding.EncodeToString(key)), nil
+}
+
+// verifyPassword checks password against a hash made by hashPassword.
+func verifyPassword(encoded, password string) (bool, error) {
+	parts := strings.Split(encoded, "$")
+	if len(parts) != 6 || parts[1] != "argon2id" {
+		return false, errBadHash
+	}
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return false, errBadHash
+	}
+	var (
+		memory, time uint32
+		threads      uint8
+	)
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &memory, &time, &threads); err != nil {
+		return false, errBadHash
+	}
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return false, errBadHash
+	}
+	want, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil || len(want) == 0 {
+		return false, errBadHash
+	}
+	got := idKey([]byte(password), salt, time, memory, threads, uint32(len(want)))
+	return subtle.ConstantTimeCompare(got, want) == 1, nil
+}
+
+// parseBasicAuth decodes an "Authorization: Basic ..." header value.
+func parseBasicAuth(header string) (username, password string, ok bool) {
+	const prefix = "basic "
+	if len(header) < len(prefix) || !strings.EqualFold(header[:len(prefix)], prefix) {
+		return "", "", false
+	}
+	raw, err := base64.StdEncoding.DecodeString(strings.TrimSpace(header[len(prefix):]))
+	if err != nil {
+		return "", "", false
+	}
+	username, password, ok = strings.Cut(string(raw), ":")
+	return username, password, ok
+}
+
+// dummyHash is verified against when the user does not exist, so a wrong
+// username takes as long as a wrong password.
+var dummyHash = sync.OnceValue(func() string {
+	h, _ := hashPassword("boltbase-dummy-password")
+	return h
+})
+
+// checkUserPassword verifies Basic credentials against the user bucket. A
+// legacy plain admin entry that matches is turned into an admin user on the
+// spot. Disabled users never match.
+func checkUserPassword(db *bolt.DB, username, password string) (User, bool, error) {
+	u, err := GetUser(db, username)
+	if err == ErrKeyNotFound {
+		u, ok, err := migrateLegacyAdmin(db, username, password)
+		if err != nil || ok {
+			return u, ok, err
+		}
+		// 用户不存在也照样计算一次 hash，避免通过响应时间区分用户名是否存在
+		verifyPassword(dummyHash(), password)
+		return User{}, false, nil
+	}
+	if err != nil {
+		return User{}, false, err
+	}
+
+	if ok, err := verifyPassword(u.Hash, password); err != nil || !ok {
+		return User{}, false, err
+	}
+	if u.Disabled {
+		return User{}, false, nil
+	}
+	return u, true, nil
+}
+
+func migrateLegacyAdmin(db *bolt.DB, username, password string) (User, bool, error) {
+	cred, err := GetAdminCredential(db)
+	if err != nil || cred.Legacy == "" {
+		return User{}, false, nil
+	}
+	want := "Basic " + base64.StdEncoding.EncodeToString([]byte(username+":"+password))
+	if subtle.ConstantTimeCompare([]byte(want), []byte(cred.Legacy)) != 1 {
+		return User{}, false, nil
+	}
+	hash, err := hashPassword(password)
+	if err != nil {
+		return User{}, false, err
+	}
+	now := time.Now().UTC()
+	u := User{Username: username, Hash: hash, Role: RoleAdmin, Created: now, Updated: now}
+	if err := ReplaceAdminCredential(db, u); err != nil {
+		return User{}, false, err
+	}
+	return u, true, nil
+}
@@ -0,0 +1,343 @@
+package bolt
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// ---------------- Rate Limits & Quotas ----------------
+//
+// Every authenticated actor (see AuthResult.Actor) gets a token bucket per
+// route class and optionally a daily request quota. The defaults come from
+// Config.RateLimit; an API key or user can carry its own Limits, whose set
+// fields take precedence.
+
+// Route classes.
+const (
+	classRead  = "read"
+	classWrite = "write"
+	classScan  = "scan"
+)
+
+// Rate is a token bucket: PerSecond requests are allowed on average and up
+// to Burst at once. A zero PerSecond means unlimited.
+type Rate struct {
+	PerSecond float64 `json:"perSecond" yaml:"perSecond"`
+	Burst     int     `json:"burst,omitempty" yaml:"burst"` // default: PerSecond rounded up
+}
+
+// Limits are the rate limits of one actor. Nil fields fall back to the
+// configured defaults.
+type Limits struct {
+	Read       *Rate `json:"read,omitempty" yaml:"read"`
+	Write      *Rate `json:"write,omitempty" yaml:"write"`
+	Scan       *Rate `json:"scan,omitempty" yaml:"scan"`
+	DailyQuota *int  `json:"dailyQuota,omitempty" yaml:"dailyQuota"` // requests per UTC day, 0 = unlimited
+}
+
+func (l *Limits) validate() error {
+	if l == nil {
+		return nil
+	}
+	for class, r := range map[string]*Rate{classRead: l.Read, classWrite: l.Write, classScan: l.Scan} {
+		if r != nil && (r.PerSecond < 0 || r.Burst < 0 || math.IsInf(r.PerSecond, 0) || math.IsNaN(r.PerSecond)) {
+			return fmt.Errorf("invalid %s rate (perSecond and burst must not be negative)", class)
+		}
+	}
+	if l.DailyQuota != nil && *l.DailyQuota < 0 {
+		return errors.New("invalid dailyQuota (must not be negative)")
+	}
+	return nil
+}
+
+// orNil returns nil for limits that set nothing, so {} resets a key or user
+// to the defaults.
+func (l *Limits) orNil() *Limits {
+	if l == nil || *l == (Limits{}) {
+		return nil
+	}
+	return l
+}
+
+func (l *Limits) rate(class string) *Rate {
+	if l == nil {
+		return nil
+	}
+	switch class {
+	case classRead:
+		return l.Read
+	case classWrite:
+		return l.Write
+	default:
+		return l.Scan
+	}
+}
+
+// effectiveRate returns the rate for class, preferring own over defaults.
+func effectiveRate(defaults, own *Limits, class string) Rate {
+	if r := own.rate(class); r != nil {
+		return *r
+	}
+	if r := defaults.rate(class); r != nil {
+		return *r
+	}
+	return Rate{}
+}
+
+func effectiveQuota(defaults, own *Limits) int {
+	if own != nil && own.DailyQuota != nil {
+		return *own.DailyQuota
+	}
+	if defaults.DailyQuota != nil {
+		return *defaults.DailyQuota
+	}
+	return 0
+}
+
+// parseRate reads "perSecond[:burst]", e.g. "50" or "50:200".
+func parseRate(v string) (Rate, error) {
+	perSecond, burst, hasBurst := strings.Cut(strings.TrimSpace(v), ":")
+	var r Rate
+	var err error
+	if r.PerSecond, err = strconv.ParseFloat(perSecond, 64); err != nil {
+		return r, fmt.Errorf("%q is not perSecond[:burst]", v)
+	}
+	if hasBurst {
+		if r.Burst, err = strconv.Atoi(burst); err != nil {
+			return r, fmt.Errorf("%q is not perSecond[:burst]", v)
+		}
+	}
+	return r, nil
+}
+
+// routeClass classifies a request for rate limiting. Requests that are not
+// limited at all return "".
+func routeClass(c *fiber.Ctx) string {
+	path := c.Path()
+	switch {
+	case path == "/health" || path == "/ready" || path == "/favicon.ico" ||
+		strings.HasPrefix(path, "/public/") || strings.HasPrefix(path, "/web/login"):
+		return ""
+	case path == "/export":
+		return classScan
+	case c.Method() != fiber.MethodGet && c.Method() != fiber.MethodHead:
+		return classWrite
+	case strings.HasPrefix(path, "/kv/prefix/") || strings.HasPrefix(path, "/kv/range/") ||
+		strings.HasPrefix(path, "/kv/all/") || strings.HasPrefix(path, "/kv/part/") ||
+		strings.HasPrefix(path, "/audit") || strings.HasPrefix(path, "/web/"):
+		return classScan
+	default:
+		return classRead
+	}
+}
+
+// rateLimitMiddleware authenticates the request (the result is reused by
+// the handler) and rejects it with 429 when the actor is over its limit.
+// Requests that fail authentication are left to the handler.
+func rateLimitMiddleware(c *fiber.Ctx) error {
+	class := routeClass(c)
+	if class == "" {
+		return c.Next()
+	}
+	var (
+		res AuthResult
+		err error
+	)
+	if c.Path() == "/" || strings.HasPrefix(c.Path(), "/web/") {
+		res, err = webAuth(c)
+	} else {
+		res, err = auth(c)
+	}
+	if err != nil {
+		return c.Next()
+	}
+
+	now := time.Now()
+	s := serverOf(c)
+	defaults := &s.RateLimit
+	if ok, retry := s.takeToken(res.Actor, class, effectiveRate(defaults, res.Limits, class), now); !ok {
+		return tooManyRequests(c, retry, fmt.Sprintf("Rate limit exceeded for %s requests", class))
+	}
+	if quota := effectiveQuota(defaults, res.Limits); quota > 0 {
+		ok, err := s.takeQuota(res.Actor, quota, now)
+		if err != nil {
+			return c.Status(500).JSON(fiber.Map{
+				"error": err.Error(),
+			})
+		}
+		if !ok {
+			midnight := now.UTC().Truncate(24 * time.Hour).Add(24 * time.Hour)
+			return tooManyRequests(c, midnight.Sub(now), fmt.Sprintf("Daily quota of %d requests exceeded", quota))
+		}
+	}
+	return c.Next()
+}
+
+func tooManyRequests(c *fiber.Ctx, retry time.Duration, msg string) error {
+	c.Set(fiber.HeaderRetryAfter, strconv.Itoa(int(math.Ceil(retry.Seconds()))))
+	return c.Status(429).JSON(fiber.Map{
+		"error": msg,
+	})
+}
+
+// ---------------- Token Buckets ----------------
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+	rate   Rate
+}
+
+type limiterTable struct {
+	mu      sync.Mutex
+	buckets map[string]*tokenBucket // by class and actor
+}
+
+func newLimiterTable() *limiterTable {
+	return &limiterTable{buckets: make(map[string]*tokenBucket)}
+}
+
+func (r Rate) burst() float64 {
+	if r.Burst > 0 {
+		return float64(r.Burst)
+	}
+	return math.Max(1, math.Ceil(r.PerSecond))
+}
+
+// takeToken takes one token from the bucket of actor and class. When it is
+// empty it returns how long until the next token.
+func (s *server) takeToken(actor, class string, r Rate, now time.Time) (bool, time.Duration) {
+	if r.PerSecond <= 0 {
+		return true, 0
+	}
+	s.limiters.mu.Lock()
+	defer s.limiters.mu.Unlock()
+	key := class + "|" + actor
+	b, ok := s.limiters.buckets[key]
+	if !ok {
+		b = &tokenBucket{tokens: r.burst(), last: now}
+		s.limiters.buckets[key] = b
+	}
+	// 限额可能已被修改，按当前的设置补充令牌
+	b.rate = r
+	b.tokens = math.Min(r.burst(), b.tokens+now.Sub(b.last).Seconds()*r.PerSecond)
+	b.last = now
+	if b.tokens < 1 {
+		return false, time.Duration((1 - b.tokens) / r.PerSecond * float64(time.Second))
+	}
+	b.tokens--
+	return true, 0
+}
+
+// pruneLimiters forgets buckets that have refilled completely; a new bucket
+// starts full, so this changes nothing but memory use.
+func (s *server) pruneLimiters() {
+	now := time.Now()
+	s.limiters.mu.Lock()
+	defer s.limiters.mu.Unlock()
+	for key, b := range s.limiters.buckets {
+		if b.tokens+now.Sub(b.last).Seconds()*b.rate.PerSecond >= b.rate.burst() {
+			delete(s.limiters.buckets, key)
+		}
+	}
+}
+
+// ---------------- Daily Quotas ----------------
+//
+// Counters are kept in memory and added to the quota bucket periodically,
+// so a restart loses at most quotaFlush worth of counts.
+
+const quotaFlush = time.Minute
+
+type quotaCounter struct {
+	count   int64 // including pending
+	pending int64 // not yet written to the quota bucket
+}
+
+type quotaTable struct {
+	mu       sync.Mutex
+	counters map[string]*quotaCounter // by quotaKey
+}
+
+func newQuotaTable() *quotaTable {
+	return &quotaTable{counters: make(map[string]*quotaCounter)}
+}
+
+// quotaKey is "<UTC day>/<actor>", so old days sort first.
+func quotaKey(day time.Time, actor string) string {
+	return day.UTC().Format(time.DateOnly) + "/" + actor
+}
+
+func (s *server) takeQuota(actor string, quota int, now time.Time) (bool, error) {
+	key := quotaKey(now, actor)
+	s.quotas.mu.Lock()
+	defer s.quotas.mu.Unlock()
+	q, ok := s.quotas.counters[key]
+	if !ok {
+		stored, err := GetQuotaUsage(s.db, key)
+		if err != nil {
+			return false, err
+		}
+		q = &quotaCounter{count: stored}
+		s.quotas.counters[key] = q
+	}
+	if q.count >= int64(quota) {
+		return false, nil
+	}
+	q.count++
+	q.pending++
+	return true, nil
+}
+
+// flushQuotas writes pending counts and forgets the counters of past days.
+func (s *server) flushQuotas() {
+	today := quotaKey(time.Now(), "")
+	s.quotas.mu.Lock()
+	pending := make(map[string]int64)
+	for key, q := range s.quotas.counters {
+		if q.pending > 0 {
+			pending[key] = q.pending
+			q.pending = 0
+		}
+		if key < today {
+			delete(s.quotas.counters, key)
+		}
+	}
+	s.quotas.mu.Unlock()
+
+	if s.db.IsReadOnly() {
+		return
+	}
+	if err := AddQuotaUsage(s.db, pending); err != nil {
+		log.Printf("Failed to record quota usage: %v", err)
+		s.restorePending(pending)
+	}
+	// 只保留最近几天的计数，方便排查
+	if _, err := DeleteQuotaUsageBefore(s.db, quotaKey(time.Now().AddDate(0, 0, -7), "")); err != nil {
+		log.Printf("Failed to prune quota usage: %v", err)
+	}
+}
+
+// restorePending puts counts that could not be written back, so the next
+// flush retries them. A past day's counter may be gone by now; it is
+// recreated and forgotten again once written.
+func (s *server) restorePending(pending map[string]int64) {
+	s.quotas.mu.Lock()
+	defer s.quotas.mu.Unlock()
+	for key, n := range pending {
+		q, ok := s.quotas.counters[key]
+		if !ok {
+			q = &quotaCounter{count: n}
+			s.quotas.counters[key] = q
+		}
+		q.pending += n
+	}
+}
@@ -1,9 +1,14 @@
 package bolt
 
 import (
-	"encoding/base64"
+	"bytes"
+	"encoding/json"
 	"errors"
+	"fmt"
+	"io"
+	"log"
 	"net/url"
+	"strings"
 
 	"time"
 
@@ -24,6 +29,7 @@ var Routes = []Route{
 
 	// kv input & delete
 	{Method: "POST", Path: "/kv", Handler: putKV},
+	{Method: "POST", Path: "/kv/bulk/:bucketName", Handler: putKVBulk},
 	{Method: "DELETE", Path: "/kv/:bucketName/:key", Handler: deleteKV},
 
 	// Query
@@ -38,15 +44,46 @@ var Routes = []Route{
 	{Method: "GET", Path: "/bucket/info/:bucketName", Handler: getInfo},
 	{Method: "POST", Path: "/export", Handler: exportdb},
 
+	// health
+	{Method: "GET", Path: "/health", Handler: health},
+	{Method: "GET", Path: "/ready", Handler: ready},
+	{Method: "PUT", Path: "/maintenance/:state", Handler: setMaintenance},
+
+	// sequence & id
+	{Method: "POST", Path: "/seq/:name", Handler: nextSeq},
+	{Method: "GET", Path: "/seq/:name", Handler: getSeq},
+	{Method: "GET", Path: "/id/:kind", Handler: newID},
+
 	// auth
 	{Method: "POST", Path: "/auth/password", Handler: createPassword},
 	{Method: "DELETE", Path: "/auth/password", Handler: deletePassword},
 	{Method: "POST", Path: "/auth/apikey", Handler: createApiKey},
 	{Method: "DELETE", Path: "/auth/apikey", Handler: deleteExpiryApiKey},
+	{Method: "GET", Path: "/auth/apikey", Handler: listApiKeys},
+	{Method: "GET", Path: "/auth/apikey/:id", Handler: getApiKey},
+	{Method: "PATCH", Path: "/auth/apikey/:id", Handler: updateApiKey},
+	{Method: "DELETE", Path: "/auth/apikey/:id", Handler: revokeApiKey},
+	{Method: "POST", Path: "/auth/apikey/:id/rotate", Handler: rotateApiKey},
+	{Method: "GET", Path: "/auth/users", Handler: listUsers},
+	{Method: "POST", Path: "/auth/users", Handler: createUser},
+	{Method: "PATCH", Path: "/auth/users/:username", Handler: updateUser},
+	{Method: "DELETE", Path: "/auth/users/:username", Handler: deleteUser},
+	{Method: "PUT", Path: "/auth/me/password", Handler: changeOwnPassword},
+	{Method: "GET", Path: "/auth/whoami", Handler: whoami},
+	{Method: "GET", Path: "/audit", Handler: getAudit},
+	{Method: "GET", Path: "/auth/lockouts", Handler: listAuthLockouts},
+	{Method: "DELETE", Path: "/auth/lockouts", Handler: clearAuthLockouts},
+	{Method: "DELETE", Path: "/auth/lockouts/:key", Handler: clearAuthLockouts},
+	{Method: "POST", Path: "/auth/login", Handler: login},
+	{Method: "POST", Path: "/auth/refresh", Handler: refreshLogin},
+	{Method: "POST", Path: "/auth/logout", Handler: logout},
 
 	// web
 	{Method: "GET", Path: "/", Handler: index},
 	{Method: "GET", Path: "/favicon.ico", Handler: favicon},
+	{Method: "GET", Path: "/web/login", Handler: loginPage},
+	{Method: "POST", Path: "/web/login", Handler: webLogin},
+	{Method: "POST", Path: "/web/logout", Handler: webLogout},
 	{Method: "GET", Path: "/web/getBuckets", Handler: getBuckets},
 	{Method: "GET", Path: "/web/getAll", Handler: getAll},
 	{Method: "GET", Path: "/web/setBucket/:bucketName", Handler: setBucket},
@@ -58,28 +95,55 @@ var Routes = []Route{
 }
 
 var (
-	db                 *bolt.DB
 	adminBucket        string = "BoltbaseAdminBucketforUsernameAndPassword"
 	metadataBucket     string = "BoltbaseMetaDataForBucketsKeyType"
 	apiKeyBucket       string = "BoltbaseApiKeyBucket"
+	sequenceBucket     string = "BoltbaseSequenceBucket"
+	userBucket         string = "BoltbaseUserBucket"
+	sessionBucket      string = "BoltbaseSessionBucket"
+	secretBucket       string = "BoltbaseSecretBucket"
+	auditBucket        string = "BoltbaseAuditBucket"
+	quotaBucket        string = "BoltbaseQuotaBucket"
 	ErrFooUnauthorized        = errors.New("unauthorized")
+	errAlreadyRotated         = errors.New("API key was already rotated")
 	errFooapiKeyExpire        = errors.New("api key expired")
 )
 
 type AuthResult struct {
 	IsAdmin, IsApiKey, HaveAdminBucket, HaveApiKeyBucket bool
+
+	Scopes   []string // what a non-admin may do, see scope.go
+	Username string   // set when a user logged in
+	Role     string   // role of the user
+	KeyID    string   // set when an API key was used
+	Actor    string   // who is calling, e.g. "user:alice" or "apikey:3f9a1c0b7e21"
+	Limits   *Limits  // rate limits of the key or user, nil = defaults
+}
+
+// isInternalBucket reports whether name is one of the buckets Boltbase uses
+// for its own bookkeeping and must never be reached through the data API.
+func isInternalBucket(name string) bool {
+	return name == metadataBucket || name == adminBucket || name == apiKeyBucket || name == sequenceBucket || name == userBucket ||
+		name == sessionBucket || name == secretBucket || name == auditBucket ||
+		name == quotaBucket
 }
 
 func createBucket(c *fiber.Ctx) error {
+	db := serverOf(c).db
 	bucketName, keyType := c.Params("bucketName"), c.Params("keyType")
 
-	if bucketName == metadataBucket || bucketName == adminBucket || bucketName == apiKeyBucket {
+	if isInternalBucket(bucketName) {
 		return c.Status(403).JSON(fiber.Map{
 			"error": "Can't access Boltbase internal buckets",
 		})
 	}
 
-	_, err := auth(c.Get("Authorization"))
+	_, err := authorize(c, scopeManageBuckets)
+	if errors.Is(err, ErrFooForbidden) {
+		return c.Status(403).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
 	if err != nil && err != ErrFooUnauthorized {
 		return c.Status(500).JSON(fiber.Map{
 			"error": err.Error(),
@@ -119,7 +183,13 @@ func createBucket(c *fiber.Ctx) error {
 }
 
 func listBuckets(c *fiber.Ctx) error {
-	auth, err := auth(c.Get("Authorization"))
+	db := serverOf(c).db
+	auth, err := auth(c)
+	if errors.Is(err, ErrFooForbidden) {
+		return c.Status(403).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
 	if err != nil && err != ErrFooUnauthorized {
 		return c.Status(500).JSON(fiber.Map{
 			"error": err.Error(),
@@ -138,7 +208,7 @@ func listBuckets(c *fiber.Ctx) error {
 
 	filtered := bucketList[:0]
 	for _, v := range bucketList {
-		if v == metadataBucket || v == adminBucket || (auth.IsApiKey && v == apiKeyBucket) {
+		if isInternalBucket(v) || !auth.canSeeBucket(v) {
 			continue
 		}
 		filtered = append(filtered, v)
@@ -152,7 +222,13 @@ func listBuckets(c *fiber.Ctx) error {
 }
 
 func listBucketsType(c *fiber.Ctx) error {
-	auth, err := auth(c.Get("Authorization"))
+	db := serverOf(c).db
+	auth, err := auth(c)
+	if errors.Is(err, ErrFooForbidden) {
+		return c.Status(403).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
 	if err != nil && err != ErrFooUnauthorized {
 		return c.Status(500).JSON(fiber.Map{
 			"error": err.Error(),
@@ -176,27 +252,35 @@ func listBucketsType(c *fiber.Ctx) error {
 				"error": err.Error(),
 			})
 		}
+		if !auth.canSeeBucket(decK) {
+			continue
+		}
 		out[decK] = v
 	}
 
-	if !auth.IsAdmin {
-		delete(out, apiKeyBucket)
-	}
+	delete(out, apiKeyBucket) // written by older versions
 	return c.Status(200).JSON(fiber.Map{
 		"bucketTypeList": out,
 	})
 }
 
 func renameBucket(c *fiber.Ctx) error {
+	db := serverOf(c).db
 	oldName, newName := c.Params("oldName"), c.Params("newName")
 
-	if oldName == metadataBucket || oldName == adminBucket || newName == metadataBucket || newName == adminBucket {
+	if isInternalBucket(oldName) || isInternalBucket(newName) {
 		return c.Status(403).JSON(fiber.Map{
 			"error": "Can't access Boltbase internal buckets",
 		})
 	}
 
-	auth, err := auth(c.Get("Authorization"))
+	_, err := authorize(c, scopeManageBuckets,
+		bucketScope("read", oldName), bucketScope("write", oldName), bucketScope("write", newName))
+	if errors.Is(err, ErrFooForbidden) {
+		return c.Status(403).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
 	if err != nil && err != ErrFooUnauthorized {
 		return c.Status(500).JSON(fiber.Map{
 			"error": err.Error(),
@@ -205,14 +289,6 @@ func renameBucket(c *fiber.Ctx) error {
 	if err == ErrFooUnauthorized {
 		return c.SendStatus(401)
 	}
-	if !auth.IsAdmin {
-		if oldName == apiKeyBucket || newName == apiKeyBucket {
-			return c.Status(403).JSON(fiber.Map{
-				"error": "Can't access Boltbase internal buckets",
-			})
-		}
-	}
-
 	if err := RenameBucket(db, oldName, newName); err != nil {
 		return c.Status(500).JSON(fiber.Map{
 			"error": err.Error(),
@@ -222,14 +298,21 @@ func renameBucket(c *fiber.Ctx) error {
 }
 
 func dropBucket(c *fiber.Ctx) error {
+	db := serverOf(c).db
 	bucketName := c.Params("bucketName")
-	if bucketName == metadataBucket || bucketName == adminBucket {
+	// admins may still drop the whole api key bucket to revoke every key at once
+	if isInternalBucket(bucketName) && bucketName != apiKeyBucket {
 		return c.Status(403).JSON(fiber.Map{
 			"error": "Can't access Boltbase internal buckets",
 		})
 	}
 
-	auth, err := auth(c.Get("Authorization"))
+	auth, err := authorize(c, scopeManageBuckets)
+	if errors.Is(err, ErrFooForbidden) {
+		return c.Status(403).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
 	if err != nil && err != ErrFooUnauthorized {
 		return c.Status(500).JSON(fiber.Map{
 			"error": err.Error(),
@@ -238,19 +321,17 @@ func dropBucket(c *fiber.Ctx) error {
 	if err == ErrFooUnauthorized {
 		return c.SendStatus(401)
 	}
-	if !auth.IsAdmin {
-		if bucketName == apiKeyBucket {
-			return c.Status(403).JSON(fiber.Map{
-				"error": "Can't access Boltbase internal buckets",
-			})
-		}
+	if bucketName == apiKeyBucket && !auth.IsAdmin {
+		return c.Status(403).JSON(fiber.Map{
+			"error": "Can't access Boltbase internal buckets",
+		})
 	}
 	if err := DropBucket(db, bucketName); err != nil {
 		return c.Status(500).JSON(fiber.Map{
 			"error": err.Error(),
 		})
 	}
-	if err := DeleteKV(db, metadataBucket, bucketName); err != nil {
+	if err := DeleteKV(db, metadataBucket, bucketName); err != nil && err != ErrKeyNotFound {
 		return c.Status(500).JSON(fiber.Map{
 			"error": err.Error(),
 		})
@@ -259,6 +340,7 @@ func dropBucket(c *fiber.Ctx) error {
 }
 
 func putKV(c *fiber.Ctx) error {
+	db := serverOf(c).db
 	type Body struct {
 		Bucket string
 		Key    string
@@ -273,14 +355,20 @@ func putKV(c *fiber.Ctx) error {
 	}
 
 	data.Bucket = url.QueryEscape(data.Bucket)
+	auditTarget(c, data.Bucket, data.Key)
 
-	if data.Bucket == metadataBucket || data.Bucket == adminBucket {
+	if isInternalBucket(data.Bucket) {
 		return c.Status(403).JSON(fiber.Map{
 			"error": "Can't access Boltbase internal buckets",
 		})
 	}
 
-	auth, err := auth(c.Get("Authorization"))
+	_, err := authorize(c, bucketScope("write", data.Bucket))
+	if errors.Is(err, ErrFooForbidden) {
+		return c.Status(403).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
 	if err != nil && err != ErrFooUnauthorized {
 		return c.Status(500).JSON(fiber.Map{
 			"error": err.Error(),
@@ -289,13 +377,6 @@ func putKV(c *fiber.Ctx) error {
 	if err == ErrFooUnauthorized {
 		return c.SendStatus(401)
 	}
-	if !auth.IsAdmin {
-		if data.Bucket == apiKeyBucket {
-			return c.Status(403).JSON(fiber.Map{
-				"error": "Can't access Boltbase internal buckets",
-			})
-		}
-	}
 
 	keyType, err := GetKV(db, metadataBucket, data.Bucket)
 	if err != nil {
@@ -310,7 +391,7 @@ func putKV(c *fiber.Ctx) error {
 				"error": err.Error(),
 			})
 		} else {
-			return c.SendStatus(201)
+			return kvCreated(c, data.Bucket, data.Key, "")
 		}
 	}
 
@@ -322,58 +403,61 @@ func putKV(c *fiber.Ctx) error {
 					"error": err.Error(),
 				})
 			} else {
-				return c.SendStatus(201)
+				return kvCreated(c, data.Bucket, data.Key, "")
 			}
 		} else if err != nil {
 			return c.Status(500).JSON(fiber.Map{
 				"error": err.Error(),
 			})
 		} else {
-			return c.Status(201).JSON(fiber.Map{
-				"warning": "key already exists",
-			})
+			return kvCreated(c, data.Bucket, data.Key, "key already exists")
 		}
 	}
 
+	var key, warning string
+
 	if keyType == "seq" {
-		if err := PutSeq(db, data.Bucket, data.Value); err != nil {
+		key, err = PutSeq(db, data.Bucket, data.Value)
+		if err != nil {
 			return c.Status(500).JSON(fiber.Map{
 				"error": err.Error(),
 			})
 		}
 		if data.Key != "" {
-			return c.Status(201).JSON(fiber.Map{
-				"warning": "The bucket is in 'seq' mode, the 'key' in the request body is ignored and the key is generated automatically by sequence.",
-			})
+			warning = "The bucket is in 'seq' mode, the 'key' in the request body is ignored and the key is generated automatically by sequence."
 		}
-
 	}
 
 	if keyType == "time" {
-		if err := PutTime(db, data.Bucket, data.Value); err != nil {
+		key, err = PutTime(db, data.Bucket, data.Value)
+		if err != nil {
 			return c.Status(500).JSON(fiber.Map{
 				"error": err.Error(),
 			})
 		}
 		if data.Key != "" {
-			return c.Status(201).JSON(fiber.Map{
-				"warning": "The bucket is in 'time' mode, the 'key' in the request body is ignored and the key is generated automatically by time.",
-			})
+			warning = "The bucket is in 'time' mode, the 'key' in the request body is ignored and the key is generated automatically by time."
 		}
 	}
 
-	return c.SendStatus(201)
+	return kvCreated(c, data.Bucket, key, warning)
 }
 
-func getKV(c *fiber.Ctx) error {
+func putKVBulk(c *fiber.Ctx) error {
+	db := serverOf(c).db
 	bucketName := c.Params("bucketName")
-	if bucketName == metadataBucket || bucketName == adminBucket {
+	if isInternalBucket(bucketName) {
 		return c.Status(403).JSON(fiber.Map{
 			"error": "Can't access Boltbase internal buckets",
 		})
 	}
 
-	auth, err := auth(c.Get("Authorization"))
+	_, err := authorize(c, bucketScope("write", bucketName))
+	if errors.Is(err, ErrFooForbidden) {
+		return c.Status(403).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
 	if err != nil && err != ErrFooUnauthorized {
 		return c.Status(500).JSON(fiber.Map{
 			"error": err.Error(),
@@ -382,12 +466,177 @@ func getKV(c *fiber.Ctx) error {
 	if err == ErrFooUnauthorized {
 		return c.SendStatus(401)
 	}
-	if !auth.IsAdmin {
-		if bucketName == apiKeyBucket {
-			return c.Status(403).JSON(fiber.Map{
-				"error": "Can't access Boltbase internal buckets",
-			})
+
+	keyType, err := GetKV(db, metadataBucket, bucketName)
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+
+	chunk := c.QueryInt("chunk", bulkChunkSize)
+	if chunk <= 0 || chunk > 10000 {
+		return c.Status(400).JSON(fiber.Map{
+			"error": "chunk must be between 1 and 10000",
+		})
+	}
+	keepKeys := c.QueryBool("keys", false)
+
+	items, err := decodeBulkBody(c.Body())
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+
+	var res BulkResult
+	if keyType == "string" {
+		pairs := make([]BulkKV, 0, len(items))
+		for i, item := range items {
+			var p struct {
+				Key   string
+				Value json.RawMessage
+			}
+			if err := json.Unmarshal(item, &p); err != nil {
+				return c.Status(400).JSON(fiber.Map{
+					"error": fmt.Sprintf("item %d: %v", i, err),
+				})
+			}
+			pairs = append(pairs, BulkKV{Key: p.Key, Value: bulkValue(p.Value)})
+		}
+		res, err = PutKVBulk(db, bucketName, pairs, c.QueryBool("update", false), chunk, keepKeys)
+	} else {
+		values := make([]string, 0, len(items))
+		skipped := 0
+		for _, item := range items {
+			if string(item) == "null" {
+				skipped++
+				continue
+			}
+			values = append(values, bulkValue(item))
+		}
+		if keyType == "seq" {
+			res, err = PutSeqBulk(db, bucketName, values, chunk, keepKeys)
+		} else {
+			res, err = PutTimeBulk(db, bucketName, values, chunk, keepKeys)
+		}
+		res.Skipped += skipped
+	}
+
+	out := fiber.Map{
+		"bucket":   bucketName,
+		"inserted": res.Inserted,
+		"skipped":  res.Skipped,
+		"firstKey": res.FirstKey,
+		"lastKey":  res.LastKey,
+	}
+	if keepKeys {
+		out["keys"] = res.Keys
+	}
+	if err != nil {
+		out["error"] = err.Error()
+		return c.Status(500).JSON(out)
+	}
+	// generated keys are increasing, so the range scan from the first to the
+	// last one reads them back (along with anything interleaved between chunks);
+	// keys of string buckets come from the client and need no link
+	if keyType != "string" && res.Inserted > 0 {
+		c.Location("/kv/range/" + bucketName + "/" + url.PathEscape(res.FirstKey) + "/" + url.PathEscape(res.LastKey))
+	}
+	return c.Status(201).JSON(out)
+}
+
+// decodeBulkBody accepts either a JSON array or a stream of newline-delimited
+// JSON values and returns the raw items.
+func decodeBulkBody(body []byte) ([]json.RawMessage, error) {
+	trimmed := bytes.TrimSpace(body)
+	if len(trimmed) == 0 {
+		return nil, errors.New("empty body")
+	}
+	if trimmed[0] == '[' {
+		var items []json.RawMessage
+		if err := json.Unmarshal(trimmed, &items); err != nil {
+			return nil, err
+		}
+		return items, nil
+	}
+
+	var items []json.RawMessage
+	dec := json.NewDecoder(bytes.NewReader(trimmed))
+	for {
+		var item json.RawMessage
+		err := dec.Decode(&item)
+		if err == io.EOF {
+			return items, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("item %d: %v", len(items), err)
 		}
+		items = append(items, item)
+	}
+}
+
+// bulkValue stores JSON strings unquoted and any other JSON value verbatim.
+func bulkValue(raw json.RawMessage) string {
+	var s string
+	if err := json.Unmarshal(raw, &s); err == nil {
+		return s
+	}
+	return string(raw)
+}
+
+// keyParam returns the :key route parameter with percent-encoding removed, so
+// keys containing '/' or spaces can be addressed by the URLs kvCreated hands out.
+func keyParam(c *fiber.Ctx) string {
+	key := c.Params("key")
+	if dec, err := url.PathUnescape(key); err == nil {
+		return dec
+	}
+	return key
+}
+
+// kvCreated answers a successful insert with the key that was written and a
+// Location header pointing at the matching GET /kv/get URL. bucket must be in
+// its stored (escaped) form; seq keys are rendered the same way scans do.
+func kvCreated(c *fiber.Ctx, bucket, key, warning string) error {
+	c.Location("/kv/get/" + bucket + "/" + url.PathEscape(key))
+
+	decBucket, err := url.QueryUnescape(bucket)
+	if err != nil {
+		decBucket = bucket
+	}
+	res := fiber.Map{
+		"bucket": decBucket,
+		"key":    key,
+	}
+	if warning != "" {
+		res["warning"] = warning
+	}
+	return c.Status(201).JSON(res)
+}
+
+func getKV(c *fiber.Ctx) error {
+	db := serverOf(c).db
+	bucketName := c.Params("bucketName")
+	if isInternalBucket(bucketName) {
+		return c.Status(403).JSON(fiber.Map{
+			"error": "Can't access Boltbase internal buckets",
+		})
+	}
+
+	_, err := authorize(c, bucketScope("read", bucketName))
+	if errors.Is(err, ErrFooForbidden) {
+		return c.Status(403).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+	if err != nil && err != ErrFooUnauthorized {
+		return c.Status(500).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+	if err == ErrFooUnauthorized {
+		return c.SendStatus(401)
 	}
 
 	keyType, err := GetKV(db, metadataBucket, bucketName)
@@ -415,7 +664,7 @@ func getKV(c *fiber.Ctx) error {
 		})
 	}
 
-	value, err := GetKV(db, bucketName, c.Params("key"))
+	value, err := GetKV(db, bucketName, keyParam(c))
 	if err != nil {
 		return c.Status(500).JSON(fiber.Map{
 			"error": err.Error(),
@@ -427,14 +676,20 @@ func getKV(c *fiber.Ctx) error {
 }
 
 func prefixScan(c *fiber.Ctx) error {
+	db := serverOf(c).db
 	bucketName := c.Params("bucketName")
-	if bucketName == metadataBucket || bucketName == adminBucket {
+	if isInternalBucket(bucketName) {
 		return c.Status(403).JSON(fiber.Map{
 			"error": "Can't access Boltbase internal buckets",
 		})
 	}
 
-	auth, err := auth(c.Get("Authorization"))
+	_, err := authorize(c, bucketScope("read", bucketName))
+	if errors.Is(err, ErrFooForbidden) {
+		return c.Status(403).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
 	if err != nil && err != ErrFooUnauthorized {
 		return c.Status(500).JSON(fiber.Map{
 			"error": err.Error(),
@@ -443,13 +698,6 @@ func prefixScan(c *fiber.Ctx) error {
 	if err == ErrFooUnauthorized {
 		return c.SendStatus(401)
 	}
-	if !auth.IsAdmin {
-		if bucketName == apiKeyBucket {
-			return c.Status(403).JSON(fiber.Map{
-				"error": "Can't access Boltbase internal buckets",
-			})
-		}
-	}
 
 	keyType, err := GetKV(db, metadataBucket, bucketName)
 	if err != nil {
@@ -492,14 +740,20 @@ func prefixScan(c *fiber.Ctx) error {
 }
 
 func rangeScan(c *fiber.Ctx) error {
+	db := serverOf(c).db
 	bucketName := c.Params("bucketName")
-	if bucketName == metadataBucket || bucketName == adminBucket {
+	if isInternalBucket(bucketName) {
 		return c.Status(403).JSON(fiber.Map{
 			"error": "Can't access Boltbase internal buckets",
 		})
 	}
 
-	auth, err := auth(c.Get("Authorization"))
+	_, err := authorize(c, bucketScope("read", bucketName))
+	if errors.Is(err, ErrFooForbidden) {
+		return c.Status(403).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
 	if err != nil && err != ErrFooUnauthorized {
 		return c.Status(500).JSON(fiber.Map{
 			"error": err.Error(),
@@ -508,13 +762,6 @@ func rangeScan(c *fiber.Ctx) error {
 	if err == ErrFooUnauthorized {
 		return c.SendStatus(401)
 	}
-	if !auth.IsAdmin {
-		if bucketName == apiKeyBucket {
-			return c.Status(403).JSON(fiber.Map{
-				"error": "Can't access Boltbase internal buckets",
-			})
-		}
-	}
 
 	keyType, err := GetKV(db, metadataBucket, bucketName)
 	if err != nil {
@@ -562,14 +809,20 @@ func rangeScan(c *fiber.Ctx) error {
 }
 
 func scanAll(c *fiber.Ctx) error {
+	db := serverOf(c).db
 	bucketName := c.Params("bucketName")
-	if bucketName == metadataBucket || bucketName == adminBucket {
+	if isInternalBucket(bucketName) {
 		return c.Status(403).JSON(fiber.Map{
 			"error": "Can't access Boltbase internal buckets",
 		})
 	}
 
-	auth, err := auth(c.Get("Authorization"))
+	_, err := authorize(c, bucketScope("read", bucketName))
+	if errors.Is(err, ErrFooForbidden) {
+		return c.Status(403).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
 	if err != nil && err != ErrFooUnauthorized {
 		return c.Status(500).JSON(fiber.Map{
 			"error": err.Error(),
@@ -578,13 +831,6 @@ func scanAll(c *fiber.Ctx) error {
 	if err == ErrFooUnauthorized {
 		return c.SendStatus(401)
 	}
-	if !auth.IsAdmin {
-		if bucketName == apiKeyBucket {
-			return c.Status(403).JSON(fiber.Map{
-				"error": "Can't access Boltbase internal buckets",
-			})
-		}
-	}
 
 	keyType, err := GetKV(db, metadataBucket, bucketName)
 	if err != nil {
@@ -620,14 +866,20 @@ func scanAll(c *fiber.Ctx) error {
 }
 
 func partScan(c *fiber.Ctx) error {
+	db := serverOf(c).db
 	bucketName := c.Params("bucketName")
-	if bucketName == metadataBucket || bucketName == adminBucket {
+	if isInternalBucket(bucketName) {
 		return c.Status(403).JSON(fiber.Map{
 			"error": "Can't access Boltbase internal buckets",
 		})
 	}
 
-	auth, err := auth(c.Get("Authorization"))
+	_, err := authorize(c, bucketScope("read", bucketName))
+	if errors.Is(err, ErrFooForbidden) {
+		return c.Status(403).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
 	if err != nil && err != ErrFooUnauthorized {
 		return c.Status(500).JSON(fiber.Map{
 			"error": err.Error(),
@@ -636,13 +888,6 @@ func partScan(c *fiber.Ctx) error {
 	if err == ErrFooUnauthorized {
 		return c.SendStatus(401)
 	}
-	if !auth.IsAdmin {
-		if bucketName == apiKeyBucket {
-			return c.Status(403).JSON(fiber.Map{
-				"error": "Can't access Boltbase internal buckets",
-			})
-		}
-	}
 
 	start, err := c.ParamsInt("start")
 	if err != nil {
@@ -691,14 +936,20 @@ func partScan(c *fiber.Ctx) error {
 }
 
 func countBucketKV(c *fiber.Ctx) error {
+	db := serverOf(c).db
 	bucketName := c.Params("bucketName")
-	if bucketName == metadataBucket || bucketName == adminBucket {
+	if isInternalBucket(bucketName) {
 		return c.Status(403).JSON(fiber.Map{
 			"error": "Can't access Boltbase internal buckets",
 		})
 	}
 
-	auth, err := auth(c.Get("Authorization"))
+	_, err := authorize(c, bucketScope("read", bucketName))
+	if errors.Is(err, ErrFooForbidden) {
+		return c.Status(403).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
 	if err != nil && err != ErrFooUnauthorized {
 		return c.Status(500).JSON(fiber.Map{
 			"error": err.Error(),
@@ -707,13 +958,6 @@ func countBucketKV(c *fiber.Ctx) error {
 	if err == ErrFooUnauthorized {
 		return c.Status(401).Send(nil)
 	}
-	if !auth.IsAdmin {
-		if bucketName == apiKeyBucket {
-			return c.Status(403).JSON(fiber.Map{
-				"error": "Can't access Boltbase internal buckets",
-			})
-		}
-	}
 
 	total, err := CountBucketKV(db, bucketName)
 	if err != nil {
@@ -727,14 +971,20 @@ func countBucketKV(c *fiber.Ctx) error {
 }
 
 func getInfo(c *fiber.Ctx) error {
+	db := serverOf(c).db
 	bucketName := c.Params("bucketName")
-	if bucketName == metadataBucket || bucketName == adminBucket {
+	if isInternalBucket(bucketName) {
 		return c.Status(403).JSON(fiber.Map{
 			"error": "Can't access Boltbase internal buckets",
 		})
 	}
 
-	auth, err := auth(c.Get("Authorization"))
+	_, err := authorize(c, bucketScope("read", bucketName))
+	if errors.Is(err, ErrFooForbidden) {
+		return c.Status(403).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
 	if err != nil && err != ErrFooUnauthorized {
 		return c.Status(500).JSON(fiber.Map{
 			"error": err.Error(),
@@ -743,13 +993,6 @@ func getInfo(c *fiber.Ctx) error {
 	if err == ErrFooUnauthorized {
 		return c.Status(401).Send(nil)
 	}
-	if !auth.IsAdmin {
-		if bucketName == apiKeyBucket {
-			return c.Status(403).JSON(fiber.Map{
-				"error": "Can't access Boltbase internal buckets",
-			})
-		}
-	}
 	info, err := GetInfo(db, bucketName)
 	if err != nil {
 		return c.Status(500).JSON(fiber.Map{
@@ -762,14 +1005,20 @@ func getInfo(c *fiber.Ctx) error {
 }
 
 func deleteKV(c *fiber.Ctx) error {
+	db := serverOf(c).db
 	bucketName := c.Params("bucketName")
-	if bucketName == metadataBucket || bucketName == adminBucket {
+	if isInternalBucket(bucketName) {
 		return c.Status(403).JSON(fiber.Map{
 			"error": "Can't access Boltbase internal buckets",
 		})
 	}
 
-	auth, err := auth(c.Get("Authorization"))
+	_, err := authorize(c, bucketScope("write", bucketName))
+	if errors.Is(err, ErrFooForbidden) {
+		return c.Status(403).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
 	if err != nil && err != ErrFooUnauthorized {
 		return c.Status(500).JSON(fiber.Map{
 			"error": err.Error(),
@@ -778,15 +1027,8 @@ func deleteKV(c *fiber.Ctx) error {
 	if err == ErrFooUnauthorized {
 		return c.Status(401).Send(nil)
 	}
-	if !auth.IsAdmin {
-		if bucketName == apiKeyBucket {
-			return c.Status(403).JSON(fiber.Map{
-				"error": "Can't access Boltbase internal buckets",
-			})
-		}
-	}
 
-	if err := DeleteKV(db, bucketName, c.Params("key")); err != nil {
+	if err := DeleteKV(db, bucketName, keyParam(c)); err != nil {
 		return c.Status(500).JSON(fiber.Map{
 			"error": err.Error(),
 		})
@@ -795,7 +1037,13 @@ func deleteKV(c *fiber.Ctx) error {
 }
 
 func exportdb(c *fiber.Ctx) error {
-	auth, err := auth(c.Get("Authorization"))
+	db := serverOf(c).db
+	auth, err := auth(c)
+	if errors.Is(err, ErrFooForbidden) {
+		return c.Status(403).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
 	if err != nil && err != ErrFooUnauthorized {
 		return c.Status(500).JSON(fiber.Map{
 			"error": err.Error(),
@@ -808,7 +1056,7 @@ func exportdb(c *fiber.Ctx) error {
 		return c.SendStatus(403)
 	}
 
-	if err := ExportDB(db, "./Boltbase.json"); err != nil {
+	if err := ExportDB(db, serverOf(c).ExportPath); err != nil {
 		return c.Status(500).JSON(fiber.Map{
 			"error": err.Error(),
 		})
@@ -816,93 +1064,381 @@ func exportdb(c *fiber.Ctx) error {
 	return c.SendStatus(201)
 }
 
-func auth(authToken string) (AuthResult, error) {
-	//
-	// authToken = apikey || Username&Password
-	//
-	// bool = is authed
-	// bool = have adminBucket
-	// bool = have apiKeyBucket
-	// error = Authorized || ErrFooUnauthorized || err
-	//
-	var (
-		haveAdminBucket  bool
-		haveApiKeyBucket bool
-	)
+// health only reports that the process is serving requests; /ready is the
+// readiness check.
+func health(c *fiber.Ctx) error {
+	return c.SendStatus(200)
+}
 
-	haveAdminBucket, err := CheckBucket(db, adminBucket)
-	if err != nil {
-		// fmt.Println("debug-auth: 1")
-		return AuthResult{false, false, false, false}, err
+// readiness reports whether this instance should receive traffic: it is not
+// shutting down or in maintenance mode, and a read transaction can see the
+// metadata bucket.
+func (s *server) readiness() (fiber.Map, error) {
+	status := fiber.Map{
+		"readOnly":    s.db.IsReadOnly(),
+		"maintenance": s.maintenance.Load(),
 	}
-
-	haveApiKeyBucket, err = CheckBucket(db, apiKeyBucket)
-	if err != nil {
-		// fmt.Println("debug-auth: 2")
-		return AuthResult{false, false, false, false}, err
+	if s.shuttingDown.Load() {
+		return status, errors.New("shutting down")
 	}
-
-	if !haveAdminBucket {
-		// fmt.Println("debug-auth: 3")
-		return AuthResult{true, false, haveAdminBucket, haveApiKeyBucket}, nil
+	if s.maintenance.Load() {
+		return status, errors.New("maintenance mode")
 	}
+	err := s.db.View(func(tx *bolt.Tx) error {
+		if tx.Bucket([]byte(metadataBucket)) == nil {
+			return errors.New("metadata bucket missing")
+		}
+		return nil
+	})
+	return status, err
+}
 
-	UsernamePassword, err := GetKV(db, adminBucket, "authToken")
+func ready(c *fiber.Ctx) error {
+	status, err := serverOf(c).readiness()
 	if err != nil {
-		// fmt.Println("debug-auth: 4")
-		return AuthResult{false, false, haveAdminBucket, haveApiKeyBucket}, err
-	}
-
-	if UsernamePassword == authToken {
-		// fmt.Println("debug-auth: 5")
-		return AuthResult{true, false, haveAdminBucket, haveApiKeyBucket}, nil
+		status["ready"] = false
+		status["reason"] = err.Error()
+		return c.Status(503).JSON(status)
 	}
+	status["ready"] = true
+	return c.Status(200).JSON(status)
+}
 
-	if !haveApiKeyBucket {
-		// fmt.Println("debug-auth: 6")
-		return AuthResult{false, false, haveAdminBucket, haveApiKeyBucket}, ErrFooUnauthorized
+func setMaintenance(c *fiber.Ctx) error {
+	auth, err := auth(c)
+	if errors.Is(err, ErrFooForbidden) {
+		return c.Status(403).JSON(fiber.Map{
+			"error": err.Error(),
+		})
 	}
-
-	expiryDate, err := GetKV(db, apiKeyBucket, authToken)
-	if err != nil && err != ErrKeyNotFound {
-		// fmt.Println("debug-auth: 7")
-		return AuthResult{false, false, haveAdminBucket, haveApiKeyBucket}, err
+	if err != nil && err != ErrFooUnauthorized {
+		return c.Status(500).JSON(fiber.Map{
+			"error": err.Error(),
+		})
 	}
-
-	if err == ErrKeyNotFound {
-		// fmt.Println("debug-auth: 8")
-		return AuthResult{false, false, haveAdminBucket, haveApiKeyBucket}, ErrFooUnauthorized
+	if err == ErrFooUnauthorized {
+		return c.SendStatus(401)
 	}
-
-	parsed, err := time.Parse(time.RFC3339, expiryDate)
-	if err != nil {
-		// fmt.Println("debug-auth: 9")
-		return AuthResult{false, false, haveAdminBucket, haveApiKeyBucket}, err
+	if !auth.IsAdmin {
+		return c.SendStatus(403)
 	}
 
-	if parsed.Before(time.Now()) {
-		// fmt.Println("debug-auth: 10")
-		return AuthResult{false, false, haveAdminBucket, haveApiKeyBucket}, errFooapiKeyExpire
+	srv := serverOf(c)
+	switch c.Params("state") {
+	case "on":
+		srv.maintenance.Store(true)
+	case "off":
+		srv.maintenance.Store(false)
+	default:
+		return c.Status(400).JSON(fiber.Map{
+			"error": "Invalid state! (must be one of: on, off)",
+		})
 	}
-
-	// fmt.Println("debug-auth: 11")
-	return AuthResult{false, true, haveAdminBucket, haveApiKeyBucket}, nil
+	return c.Status(200).JSON(fiber.Map{
+		"maintenance": srv.maintenance.Load(),
+	})
 }
 
-func createPassword(c *fiber.Ctx) error {
-	auth, err := auth(c.Get("Authorization"))
+func nextSeq(c *fiber.Ctx) error {
+	db := serverOf(c).db
+	_, err := authorize(c, "seq:"+c.Params("name"))
+	if errors.Is(err, ErrFooForbidden) {
+		return c.Status(403).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
 	if err != nil && err != ErrFooUnauthorized {
 		return c.Status(500).JSON(fiber.Map{
 			"error": err.Error(),
 		})
 	}
 	if err == ErrFooUnauthorized {
-		return c.Status(401).Send(nil)
-	}
-	if !auth.IsAdmin {
-		return c.Status(403).Send(nil)
+		return c.SendStatus(401)
 	}
-	if !auth.HaveAdminBucket {
+
+	name := c.Params("name")
+	count := c.QueryInt("count", 1)
+	if count <= 0 {
+		return c.Status(400).JSON(fiber.Map{
+			"error": "count must be >0",
+		})
+	}
+
+	start, err := NextSeq(db, name, uint64(count))
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+	return c.Status(200).JSON(fiber.Map{
+		"name":  name,
+		"value": start,
+		"end":   start + uint64(count) - 1,
+		"count": count,
+	})
+}
+
+func getSeq(c *fiber.Ctx) error {
+	db := serverOf(c).db
+	_, err := authorize(c, "seq:"+c.Params("name"))
+	if errors.Is(err, ErrFooForbidden) {
+		return c.Status(403).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+	if err != nil && err != ErrFooUnauthorized {
+		return c.Status(500).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+	if err == ErrFooUnauthorized {
+		return c.SendStatus(401)
+	}
+
+	name := c.Params("name")
+	value, err := GetSeq(db, name)
+	if errors.Is(err, ErrKeyNotFound) {
+		return c.Status(404).JSON(fiber.Map{
+			"error": "sequence not found",
+		})
+	}
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+	return c.Status(200).JSON(fiber.Map{
+		"name":  name,
+		"value": value,
+	})
+}
+
+func newID(c *fiber.Ctx) error {
+	_, err := authorize(c, "id:"+c.Params("kind"))
+	if errors.Is(err, ErrFooForbidden) {
+		return c.Status(403).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+	if err != nil && err != ErrFooUnauthorized {
+		return c.Status(500).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+	if err == ErrFooUnauthorized {
+		return c.SendStatus(401)
+	}
+
+	count := c.QueryInt("count", 1)
+	if count <= 0 || count > 1000 {
+		return c.Status(400).JSON(fiber.Map{
+			"error": "count must be between 1 and 1000",
+		})
+	}
+
+	var gen func() (string, error)
+	switch c.Params("kind") {
+	case "ulid":
+		gen = NewULID
+	case "uuidv7":
+		gen = func() (string, error) {
+			id, err := uuid.NewV7()
+			return id.String(), err
+		}
+	default:
+		return c.Status(400).JSON(fiber.Map{
+			"error": "Invalid kind! (must be one of: ulid, uuidv7)",
+		})
+	}
+
+	ids := make([]string, 0, count)
+	for range count {
+		id, err := gen()
+		if err != nil {
+			return c.Status(500).JSON(fiber.Map{
+				"error": err.Error(),
+			})
+		}
+		ids = append(ids, id)
+	}
+	return c.Status(200).JSON(fiber.Map{
+		"ids":   ids,
+		"total": len(ids),
+	})
+}
+
+// authOutcome caches the result of auth for the rest of the request.
+type authOutcome struct {
+	res AuthResult
+	err error
+}
+
+const authLocal = "boltbase.auth"
+
+// auth authenticates the request and remembers the actor for the audit log.
+// The rate limiter authenticates first, so handlers get the cached result.
+func auth(c *fiber.Ctx) (AuthResult, error) {
+	if o, ok := c.Locals(authLocal).(authOutcome); ok {
+		return o.res, o.err
+	}
+	res, err := authenticate(c)
+	c.Locals(authLocal, authOutcome{res, err})
+	if err == nil {
+		setActor(c, res.Actor)
+	}
+
+	// 只统计带了凭证却认证失败的请求，没带凭证不算；密码错误已经在
+	// checkPasswordFrom 中统计过
+	header := c.Get("Authorization")
+	username, _, isBasic := parseBasicAuth(header)
+	switch {
+	case err == ErrFooUnauthorized && !isBasic && (header != "" || isSignedRequest(c)):
+		serverOf(c).recordAuthFailure(authLockoutKeys(c, username)...)
+	case err == nil && isBasic && res.Username == username:
+		serverOf(c).clearAuthFailures(userLockoutKey(username))
+	}
+	return res, err
+}
+
+func authenticate(c *fiber.Ctx) (AuthResult, error) {
+	//
+	// authToken = apikey || Username&Password || Bearer access token
+	// or a verified client certificate mapped in TLSConfig.ClientRoles
+	// or a trusted peer on the unix socket (UnixConfig.AdminPeers)
+	//
+	// error = Authorized || ErrFooUnauthorized || err
+	//
+	var (
+		res       AuthResult
+		authToken = c.Get("Authorization")
+		err       error
+		srv       = serverOf(c)
+		db        = srv.db
+	)
+
+	res.HaveAdminBucket, err = CheckBucket(db, adminBucket)
+	if err != nil {
+		// fmt.Println("debug-auth: 1")
+		return AuthResult{}, err
+	}
+
+	res.HaveApiKeyBucket, err = CheckBucket(db, apiKeyBucket)
+	if err != nil {
+		// fmt.Println("debug-auth: 2")
+		return AuthResult{}, err
+	}
+
+	if !res.HaveAdminBucket {
+		// fmt.Println("debug-auth: 3")
+		res.IsAdmin, res.Actor = true, "anonymous"
+		return res, nil
+	}
+
+	if uid, ok := peerIsAdmin(c); ok {
+		res.IsAdmin, res.Actor = true, fmt.Sprintf("peer:uid=%d", uid)
+		return res, nil
+	}
+
+	switch role, name := clientCertRole(c); role {
+	case "admin":
+		res.IsAdmin, res.Actor = true, "cert:"+name
+		return res, nil
+	case "apikey":
+		res.IsApiKey, res.Scopes, res.Actor = true, []string{scopeAll}, "cert:"+name
+		return res, nil
+	}
+
+	if username, password, ok := parseBasicAuth(authToken); ok {
+		u, ok, err := checkPasswordFrom(c, username, password)
+		if err != nil {
+			// fmt.Println("debug-auth: 4")
+			return res, err
+		}
+		if ok {
+			// fmt.Println("debug-auth: 5")
+			res.setUser(u)
+			return res, nil
+		}
+	}
+
+	if token, ok := parseBearer(authToken); ok {
+		u, err := srv.bearerUser(token)
+		if err == ErrKeyNotFound {
+			return res, ErrFooUnauthorized
+		}
+		if err != nil {
+			return res, err
+		}
+		res.setUser(u)
+		return res, nil
+	}
+
+	if !res.HaveApiKeyBucket {
+		// fmt.Println("debug-auth: 6")
+		return res, ErrFooUnauthorized
+	}
+
+	var key APIKey
+	if isSignedRequest(c) {
+		key, err = verifySignedRequest(c)
+	} else if key, err = lookupAPIKey(db, authToken); err == nil && key.Signing {
+		// 签名密钥只能用来签名，不能直接放在 Authorization 里发送
+		err = ErrKeyNotFound
+	}
+	if err != nil && err != ErrKeyNotFound {
+		// fmt.Println("debug-auth: 7")
+		return res, err
+	}
+
+	if err == ErrKeyNotFound {
+		// fmt.Println("debug-auth: 8")
+		return res, ErrFooUnauthorized
+	}
+
+	if key.Expiry.Before(time.Now()) {
+		// fmt.Println("debug-auth: 10")
+		return res, errFooapiKeyExpire
+	}
+
+	if ip := clientIP(c); !ipAllowed(key.AllowedCIDRs, ip) {
+		return res, fmt.Errorf("%w: %w: apikey:%s used from %s", ErrFooForbidden, ErrFooIPNotAllowed, key.ID, ip)
+	}
+
+	// fmt.Println("debug-auth: 11")
+	srv.markAPIKeyUsed(key.ID)
+	res.IsApiKey, res.Scopes, res.Limits = true, key.Scopes, key.Limits
+	res.KeyID, res.Actor = key.ID, "apikey:"+key.ID
+	return res, nil
+}
+
+// setUser fills in the identity and permissions of a logged in user.
+func (a *AuthResult) setUser(u User) {
+	a.IsAdmin = u.Role == RoleAdmin
+	a.Scopes = roleScopes[u.Role]
+	a.Username, a.Role, a.Actor = u.Username, u.Role, "user:"+u.Username
+	a.Limits = u.Limits
+}
+
+func createPassword(c *fiber.Ctx) error {
+	db := serverOf(c).db
+	auth, err := auth(c)
+	if errors.Is(err, ErrFooForbidden) {
+		return c.Status(403).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+	if err != nil && err != ErrFooUnauthorized {
+		return c.Status(500).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+	if err == ErrFooUnauthorized {
+		return c.Status(401).Send(nil)
+	}
+	if !auth.IsAdmin {
+		return c.Status(403).Send(nil)
+	}
+	if !auth.HaveAdminBucket {
 		if err := CreateBucket(db, adminBucket); err != nil {
 			return c.Status(500).JSON(fiber.Map{
 				"error": err.Error(),
@@ -919,15 +1455,28 @@ func createPassword(c *fiber.Ctx) error {
 			"error": err.Error(),
 		})
 	}
-	if admin.Username == "" || admin.Password == "" {
+	if err := validUser(admin.Username, admin.Password); err != nil {
 		return c.Status(400).JSON(fiber.Map{
-			"error": "UserName or Password cannot be empty",
+			"error": err.Error(),
+		})
+	}
+	hash, err := hashPassword(admin.Password)
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+	// creates the admin user, or resets the password of an existing user and
+	// makes it an enabled admin
+	now := time.Now().UTC()
+	err = CreateUser(db, User{Username: admin.Username, Hash: hash, Role: RoleAdmin, Created: now, Updated: now})
+	if err == ErrUserExists {
+		_, err = UpdateUser(db, admin.Username, func(u *User) error {
+			u.Hash, u.Role, u.Disabled, u.Updated = hash, RoleAdmin, false, now
+			return nil
 		})
 	}
-	raw := admin.Username + ":" + admin.Password
-	encoded := base64.StdEncoding.EncodeToString([]byte(raw))
-	authHeader := "Basic " + encoded
-	if err := PutKV(db, adminBucket, "authToken", authHeader); err != nil {
+	if err != nil {
 		return c.Status(500).JSON(fiber.Map{
 			"error": err.Error(),
 		})
@@ -936,7 +1485,13 @@ func createPassword(c *fiber.Ctx) error {
 }
 
 func deletePassword(c *fiber.Ctx) error {
-	auth, err := auth(c.Get("Authorization"))
+	db := serverOf(c).db
+	auth, err := auth(c)
+	if errors.Is(err, ErrFooForbidden) {
+		return c.Status(403).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
 	if err != nil && err != ErrFooUnauthorized {
 		return c.Status(500).JSON(fiber.Map{
 			"error": err.Error(),
@@ -960,16 +1515,28 @@ func deletePassword(c *fiber.Ctx) error {
 		})
 	}
 
-	if err := DropBucket(db, adminBucket); err != nil {
-		return c.Status(500).JSON(fiber.Map{
-			"error": err.Error(),
-		})
+	// back to development mode: all users go with the admin bucket
+	for _, b := range []string{adminBucket, userBucket, sessionBucket} {
+		if ok, _ := CheckBucket(db, b); !ok {
+			continue
+		}
+		if err := DropBucket(db, b); err != nil {
+			return c.Status(500).JSON(fiber.Map{
+				"error": err.Error(),
+			})
+		}
 	}
 	return c.SendStatus(200)
 }
 
 func createApiKey(c *fiber.Ctx) error {
-	auth, err := auth(c.Get("Authorization"))
+	db := serverOf(c).db
+	auth, err := auth(c)
+	if errors.Is(err, ErrFooForbidden) {
+		return c.Status(403).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
 	if err != nil && err != ErrFooUnauthorized {
 		return c.Status(500).JSON(fiber.Map{
 			"error": err.Error(),
@@ -981,20 +1548,15 @@ func createApiKey(c *fiber.Ctx) error {
 	if !auth.IsAdmin {
 		return c.SendStatus(403)
 	}
-	if !auth.HaveApiKeyBucket {
-		if err := CreateBucket(db, apiKeyBucket); err != nil {
-			return c.Status(500).JSON(fiber.Map{
-				"error": err.Error(),
-			})
-		}
-		if err := PutKV(db, metadataBucket, apiKeyBucket, "string"); err != nil {
-			return c.Status(500).JSON(fiber.Map{
-				"error": err.Error(),
-			})
-		}
-	}
 	type request struct {
 		Duration string
+		Label    string
+		Owner    string
+		Scopes   []string
+		Limits   *Limits
+		Signing  bool // see signing.go
+
+		AllowedCIDRs []string
 	}
 	var expiryDate request
 	if err := c.BodyParser(&expiryDate); err != nil {
@@ -1002,27 +1564,89 @@ func createApiKey(c *fiber.Ctx) error {
 			"error": err.Error(),
 		})
 	}
+	if err := expiryDate.Limits.validate(); err != nil {
+		return c.Status(400).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+	allowed, err := normalizeCIDRs(expiryDate.AllowedCIDRs)
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+	// 没有 scope 的密钥什么都不能做，不允许创建这样的密钥
+	if len(expiryDate.Scopes) == 0 {
+		return c.Status(400).JSON(fiber.Map{
+			"error": fmt.Sprintf("Scopes is required, e.g. [\"read:orders\"] or [\"%s\"] for everything an API key can do", scopeAll),
+		})
+	}
+	for _, s := range expiryDate.Scopes {
+		if err := validScope(s); err != nil {
+			return c.Status(400).JSON(fiber.Map{
+				"error": err.Error(),
+			})
+		}
+	}
 	future_s2d, err := str2duration.ParseDuration(expiryDate.Duration)
 	if err != nil {
 		return c.Status(500).JSON(fiber.Map{
 			"error": err.Error(),
 		})
 	}
-	future_string := time.Now().UTC().Add(future_s2d).Format(time.RFC3339)
-	uuid := uuid.NewString()
-	if err := PutKV(db, apiKeyBucket, uuid, future_string); err != nil {
+	now := time.Now().UTC()
+	expiry := now.Add(future_s2d).Truncate(time.Second)
+	token, id, err := newAPIKeyToken()
+	if err != nil {
 		return c.Status(500).JSON(fiber.Map{
 			"error": err.Error(),
 		})
 	}
-	return c.Status(201).JSON(fiber.Map{
-		"apiKey":     uuid,
-		"expiryTime": future_string,
-	})
+	key := APIKey{
+		ID:      id,
+		Prefix:  apiKeyTokenPrefix + id,
+		Hash:    hashAPIKey(token),
+		Label:   expiryDate.Label,
+		Owner:   expiryDate.Owner,
+		Scopes:  expiryDate.Scopes,
+		Limits:  expiryDate.Limits.orNil(),
+		Signing: expiryDate.Signing,
+		Created: now,
+		Expiry:  expiry,
+
+		AllowedCIDRs: allowed,
+	}
+	if err := PutAPIKey(db, key); err != nil {
+		return c.Status(500).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+	// the token is not stored and cannot be shown again; a signing key
+	// never sends it, so it gets only the signing key
+	resp := fiber.Map{
+		"id":         id,
+		"expiryTime": expiry.Format(time.RFC3339),
+	}
+	if key.Signing {
+		if resp["signingKey"], err = apiKeySigningKey(db, id); err != nil {
+			return c.Status(500).JSON(fiber.Map{
+				"error": err.Error(),
+			})
+		}
+	} else {
+		resp["apiKey"] = token
+	}
+	return c.Status(201).JSON(resp)
 }
 
 func deleteExpiryApiKey(c *fiber.Ctx) error {
-	auth, err := auth(c.Get("Authorization"))
+	db := serverOf(c).db
+	auth, err := auth(c)
+	if errors.Is(err, ErrFooForbidden) {
+		return c.Status(403).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
 	if err != nil && err != ErrFooUnauthorized {
 		return c.Status(500).JSON(fiber.Map{
 			"error": err.Error(),
@@ -1035,27 +1659,1058 @@ func deleteExpiryApiKey(c *fiber.Ctx) error {
 		return c.SendStatus(403)
 	}
 
-	apiKeyMap, err := ScanAll(db, apiKeyBucket)
-	if err != nil {
+	if _, err := DeleteExpiredAPIKeys(db, time.Now()); err != nil {
 		return c.Status(500).JSON(fiber.Map{
 			"error": err.Error(),
 		})
 	}
-	now := time.Now().UTC()
-	for k, v := range apiKeyMap {
-		t, err := time.Parse(time.RFC3339, v)
-		if err != nil {
-			return c.Status(500).JSON(fiber.Map{
-				"error": err.Error(),
-			})
-		}
-		if t.Before(now) {
-			if err := DeleteKV(db, apiKeyBucket, k); err != nil {
-				return c.Status(500).JSON(fiber.Map{
-					"error": err.Error(),
-				})
-			}
-		}
-	}
 	return c.SendStatus(204)
 }
+
+// apiKeyInfo is what the management endpoints show of a key: everything
+// except the hash.
+func (s *server) apiKeyInfo(key APIKey) fiber.Map {
+	key = s.withPendingUsage(key)
+	info := fiber.Map{
+		"id":      key.ID,
+		"prefix":  key.Prefix,
+		"label":   key.Label,
+		"owner":   key.Owner,
+		"scopes":  key.Scopes,
+		"created": key.Created.Format(time.RFC3339),
+		"expiry":  key.Expiry.Format(time.RFC3339),
+		"expired": key.Expiry.Before(time.Now()),
+	}
+	if !key.LastUsed.IsZero() {
+		info["lastUsed"] = key.LastUsed.Format(time.RFC3339)
+	}
+	if key.Limits != nil {
+		info["limits"] = key.Limits
+	}
+	if len(key.AllowedCIDRs) > 0 {
+		info["allowedCIDRs"] = key.AllowedCIDRs
+	}
+	if key.Signing {
+		info["signing"] = true
+	}
+	if key.Replaces != "" {
+		info["replaces"] = key.Replaces
+	}
+	if key.ReplacedBy != "" {
+		info["replacedBy"] = key.ReplacedBy
+	}
+	return info
+}
+
+func listApiKeys(c *fiber.Ctx) error {
+	db := serverOf(c).db
+	auth, err := auth(c)
+	if errors.Is(err, ErrFooForbidden) {
+		return c.Status(403).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+	if err != nil && err != ErrFooUnauthorized {
+		return c.Status(500).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+	if err == ErrFooUnauthorized {
+		return c.SendStatus(401)
+	}
+	if !auth.IsAdmin {
+		return c.SendStatus(403)
+	}
+
+	keys, err := ListAPIKeys(db)
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+	list := make([]fiber.Map, 0, len(keys))
+	for _, key := range keys {
+		list = append(list, serverOf(c).apiKeyInfo(key))
+	}
+	return c.Status(200).JSON(fiber.Map{
+		"keys":  list,
+		"total": len(list),
+	})
+}
+
+func getApiKey(c *fiber.Ctx) error {
+	db := serverOf(c).db
+	auth, err := auth(c)
+	if errors.Is(err, ErrFooForbidden) {
+		return c.Status(403).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+	if err != nil && err != ErrFooUnauthorized {
+		return c.Status(500).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+	if err == ErrFooUnauthorized {
+		return c.SendStatus(401)
+	}
+	if !auth.IsAdmin {
+		return c.SendStatus(403)
+	}
+
+	key, err := GetAPIKey(db, c.Params("id"))
+	if err == ErrKeyNotFound {
+		return c.Status(404).JSON(fiber.Map{
+			"error": "API key not found",
+		})
+	}
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+	return c.Status(200).JSON(serverOf(c).apiKeyInfo(key))
+}
+
+// updateApiKey changes the label/owner of a key or moves its expiry to
+// Duration from now. Fields left out of the body are not changed.
+func updateApiKey(c *fiber.Ctx) error {
+	db := serverOf(c).db
+	auth, err := auth(c)
+	if errors.Is(err, ErrFooForbidden) {
+		return c.Status(403).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+	if err != nil && err != ErrFooUnauthorized {
+		return c.Status(500).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+	if err == ErrFooUnauthorized {
+		return c.SendStatus(401)
+	}
+	if !auth.IsAdmin {
+		return c.SendStatus(403)
+	}
+
+	type request struct {
+		Label    *string
+		Owner    *string
+		Scopes   *[]string
+		Limits   *Limits
+		Duration string
+
+		AllowedCIDRs *[]string
+	}
+	var req request
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(400).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+	if err := req.Limits.validate(); err != nil {
+		return c.Status(400).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+	var allowed []string
+	if req.AllowedCIDRs != nil {
+		if allowed, err = normalizeCIDRs(*req.AllowedCIDRs); err != nil {
+			return c.Status(400).JSON(fiber.Map{
+				"error": err.Error(),
+			})
+		}
+	}
+	if req.Scopes != nil {
+		for _, s := range *req.Scopes {
+			if err := validScope(s); err != nil {
+				return c.Status(400).JSON(fiber.Map{
+					"error": err.Error(),
+				})
+			}
+		}
+	}
+	var expiry time.Time
+	if req.Duration != "" {
+		d, err := str2duration.ParseDuration(req.Duration)
+		if err != nil {
+			return c.Status(400).JSON(fiber.Map{
+				"error": err.Error(),
+			})
+		}
+		expiry = time.Now().UTC().Add(d).Truncate(time.Second)
+	}
+
+	key, err := UpdateAPIKey(db, c.Params("id"), func(key *APIKey) error {
+		if req.Label != nil {
+			key.Label = *req.Label
+		}
+		if req.Owner != nil {
+			key.Owner = *req.Owner
+		}
+		if req.Scopes != nil {
+			key.Scopes = *req.Scopes
+		}
+		if req.Limits != nil {
+			key.Limits = req.Limits.orNil()
+		}
+		if req.AllowedCIDRs != nil {
+			key.AllowedCIDRs = allowed
+		}
+		if !expiry.IsZero() {
+			key.Expiry = expiry
+		}
+		return nil
+	})
+	if err == ErrKeyNotFound {
+		return c.Status(404).JSON(fiber.Map{
+			"error": "API key not found",
+		})
+	}
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+	return c.Status(200).JSON(serverOf(c).apiKeyInfo(key))
+}
+
+func revokeApiKey(c *fiber.Ctx) error {
+	db := serverOf(c).db
+	auth, err := auth(c)
+	if errors.Is(err, ErrFooForbidden) {
+		return c.Status(403).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+	if err != nil && err != ErrFooUnauthorized {
+		return c.Status(500).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+	if err == ErrFooUnauthorized {
+		return c.SendStatus(401)
+	}
+	if !auth.IsAdmin {
+		return c.SendStatus(403)
+	}
+
+	if err := DeleteAPIKey(db, c.Params("id")); err != nil {
+		if err == ErrKeyNotFound {
+			return c.Status(404).JSON(fiber.Map{
+				"error": "API key not found",
+			})
+		}
+		return c.Status(500).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+	return c.SendStatus(204)
+}
+
+// defaultRotateGrace is how long the old key keeps working after a rotation
+// when the request does not say otherwise.
+const defaultRotateGrace = time.Hour
+
+// rotateApiKey issues a new secret for a key. The new key gets the label and
+// owner of the old one and, unless Duration is given, the same lifetime. The
+// old key stays valid for Grace (at most until its own expiry) so clients
+// can be switched over.
+func rotateApiKey(c *fiber.Ctx) error {
+	db := serverOf(c).db
+	auth, err := auth(c)
+	if errors.Is(err, ErrFooForbidden) {
+		return c.Status(403).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+	if err != nil && err != ErrFooUnauthorized {
+		return c.Status(500).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+	if err == ErrFooUnauthorized {
+		return c.SendStatus(401)
+	}
+	if !auth.IsAdmin {
+		return c.SendStatus(403)
+	}
+
+	type request struct {
+		Grace    string
+		Duration string
+	}
+	var req request
+	if len(c.Body()) > 0 {
+		if err := c.BodyParser(&req); err != nil {
+			return c.Status(400).JSON(fiber.Map{
+				"error": err.Error(),
+			})
+		}
+	}
+	grace := defaultRotateGrace
+	if req.Grace != "" {
+		if grace, err = str2duration.ParseDuration(req.Grace); err != nil || grace < 0 {
+			return c.Status(400).JSON(fiber.Map{
+				"error": "Invalid Grace duration",
+			})
+		}
+	}
+	var lifetime time.Duration
+	if req.Duration != "" {
+		if lifetime, err = str2duration.ParseDuration(req.Duration); err != nil {
+			return c.Status(400).JSON(fiber.Map{
+				"error": err.Error(),
+			})
+		}
+	}
+
+	token, newID, err := newAPIKeyToken()
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+	now := time.Now().UTC()
+	old, repl, err := RotateAPIKey(db, c.Params("id"), func(old *APIKey) (APIKey, error) {
+		if old.ReplacedBy != "" {
+			return APIKey{}, errAlreadyRotated
+		}
+		d := lifetime
+		if req.Duration == "" {
+			d = old.Expiry.Sub(old.Created)
+		}
+		repl := APIKey{
+			ID:       newID,
+			Prefix:   apiKeyTokenPrefix + newID,
+			Hash:     hashAPIKey(token),
+			Label:    old.Label,
+			Owner:    old.Owner,
+			Scopes:   old.Scopes,
+			Limits:   old.Limits,
+			Signing:  old.Signing,
+			Created:  now,
+			Expiry:   now.Add(d).Truncate(time.Second),
+			Replaces: old.ID,
+
+			AllowedCIDRs: old.AllowedCIDRs,
+		}
+		if end := now.Add(grace).Truncate(time.Second); end.Before(old.Expiry) {
+			old.Expiry = end
+		}
+		old.ReplacedBy = newID
+		return repl, nil
+	})
+	switch err {
+	case nil:
+	case ErrKeyNotFound:
+		return c.Status(404).JSON(fiber.Map{
+			"error": "API key not found",
+		})
+	case errAlreadyRotated:
+		return c.Status(409).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	default:
+		return c.Status(500).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+
+	// the new token is not stored and cannot be shown again; as on
+	// create, a signing key gets only the signing key
+	resp := fiber.Map{
+		"id":         repl.ID,
+		"expiryTime": repl.Expiry.Format(time.RFC3339),
+		"old":        serverOf(c).apiKeyInfo(old),
+	}
+	if repl.Signing {
+		if resp["signingKey"], err = apiKeySigningKey(db, repl.ID); err != nil {
+			return c.Status(500).JSON(fiber.Map{
+				"error": err.Error(),
+			})
+		}
+	} else {
+		resp["apiKey"] = token
+	}
+	return c.Status(201).JSON(resp)
+}
+
+// validUser checks a username/password pair for a new user or password.
+func validUser(username, password string) error {
+	if username == "" || password == "" {
+		return errors.New("UserName or Password cannot be empty")
+	}
+	if strings.Contains(username, ":") {
+		return errors.New("UserName cannot contain ':'")
+	}
+	return nil
+}
+
+func userInfo(u User) fiber.Map {
+	info := fiber.Map{
+		"username": u.Username,
+		"role":     u.Role,
+		"disabled": u.Disabled,
+		"created":  u.Created.Format(time.RFC3339),
+		"updated":  u.Updated.Format(time.RFC3339),
+	}
+	if u.Limits != nil {
+		info["limits"] = u.Limits
+	}
+	return info
+}
+
+func listUsers(c *fiber.Ctx) error {
+	db := serverOf(c).db
+	auth, err := auth(c)
+	if errors.Is(err, ErrFooForbidden) {
+		return c.Status(403).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+	if err != nil && err != ErrFooUnauthorized {
+		return c.Status(500).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+	if err == ErrFooUnauthorized {
+		return c.SendStatus(401)
+	}
+	if !auth.IsAdmin {
+		return c.SendStatus(403)
+	}
+
+	users, err := ListUsers(db)
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+	list := make([]fiber.Map, 0, len(users))
+	for _, u := range users {
+		list = append(list, userInfo(u))
+	}
+	return c.Status(200).JSON(fiber.Map{
+		"users": list,
+		"total": len(list),
+	})
+}
+
+// createUser adds a user. In development mode (no admin bucket yet) the first
+// user must be an admin, and creating it turns authentication on.
+func createUser(c *fiber.Ctx) error {
+	db := serverOf(c).db
+	auth, err := auth(c)
+	if errors.Is(err, ErrFooForbidden) {
+		return c.Status(403).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+	if err != nil && err != ErrFooUnauthorized {
+		return c.Status(500).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+	if err == ErrFooUnauthorized {
+		return c.SendStatus(401)
+	}
+	if !auth.IsAdmin {
+		return c.SendStatus(403)
+	}
+
+	type request struct {
+		Username string
+		Password string
+		Role     string
+		Limits   *Limits
+	}
+	var req request
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(400).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+	if err := req.Limits.validate(); err != nil {
+		return c.Status(400).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+	if err := validUser(req.Username, req.Password); err != nil {
+		return c.Status(400).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+	if !validRole(req.Role) {
+		return c.Status(400).JSON(fiber.Map{
+			"error": "Invalid Role! (must be one of: admin, editor, viewer)",
+		})
+	}
+	if !auth.HaveAdminBucket && req.Role != RoleAdmin {
+		return c.Status(400).JSON(fiber.Map{
+			"error": "The first user must be an admin",
+		})
+	}
+
+	hash, err := hashPassword(req.Password)
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+	now := time.Now().UTC()
+	u := User{Username: req.Username, Hash: hash, Role: req.Role, Limits: req.Limits.orNil(), Created: now, Updated: now}
+	if err := CreateUser(db, u); err != nil {
+		if err == ErrUserExists {
+			return c.Status(409).JSON(fiber.Map{
+				"error": err.Error(),
+			})
+		}
+		return c.Status(500).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+	if !auth.HaveAdminBucket {
+		if err := CreateBucket(db, adminBucket); err != nil {
+			return c.Status(500).JSON(fiber.Map{
+				"error": err.Error(),
+			})
+		}
+	}
+	return c.Status(201).JSON(userInfo(u))
+}
+
+// updateUser assigns a role, disables/enables a user or resets its password.
+// Fields left out of the body are not changed.
+func updateUser(c *fiber.Ctx) error {
+	db := serverOf(c).db
+	auth, err := auth(c)
+	if errors.Is(err, ErrFooForbidden) {
+		return c.Status(403).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+	if err != nil && err != ErrFooUnauthorized {
+		return c.Status(500).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+	if err == ErrFooUnauthorized {
+		return c.SendStatus(401)
+	}
+	if !auth.IsAdmin {
+		return c.SendStatus(403)
+	}
+
+	type request struct {
+		Role     *string
+		Disabled *bool
+		Password *string
+		Limits   *Limits
+	}
+	var req request
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(400).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+	if err := req.Limits.validate(); err != nil {
+		return c.Status(400).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+	if req.Role != nil && !validRole(*req.Role) {
+		return c.Status(400).JSON(fiber.Map{
+			"error": "Invalid Role! (must be one of: admin, editor, viewer)",
+		})
+	}
+	var hash string
+	if req.Password != nil {
+		if *req.Password == "" {
+			return c.Status(400).JSON(fiber.Map{
+				"error": "Password cannot be empty",
+			})
+		}
+		if hash, err = hashPassword(*req.Password); err != nil {
+			return c.Status(500).JSON(fiber.Map{
+				"error": err.Error(),
+			})
+		}
+	}
+
+	u, err := UpdateUser(db, c.Params("username"), func(u *User) error {
+		if req.Role != nil {
+			u.Role = *req.Role
+		}
+		if req.Disabled != nil {
+			u.Disabled = *req.Disabled
+		}
+		if req.Limits != nil {
+			u.Limits = req.Limits.orNil()
+		}
+		if hash != "" {
+			u.Hash = hash
+		}
+		u.Updated = time.Now().UTC()
+		return nil
+	})
+	if err == nil && (req.Disabled != nil && *req.Disabled || hash != "") {
+		err = revokeUserSessions(db, u.Username)
+	}
+	switch err {
+	case nil:
+		return c.Status(200).JSON(userInfo(u))
+	case ErrKeyNotFound:
+		return c.Status(404).JSON(fiber.Map{
+			"error": "User not found",
+		})
+	case ErrLastAdmin:
+		return c.Status(409).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	default:
+		return c.Status(500).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+}
+
+func deleteUser(c *fiber.Ctx) error {
+	db := serverOf(c).db
+	auth, err := auth(c)
+	if errors.Is(err, ErrFooForbidden) {
+		return c.Status(403).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+	if err != nil && err != ErrFooUnauthorized {
+		return c.Status(500).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+	if err == ErrFooUnauthorized {
+		return c.SendStatus(401)
+	}
+	if !auth.IsAdmin {
+		return c.SendStatus(403)
+	}
+
+	username := c.Params("username")
+	err = DeleteUser(db, username)
+	if err == nil {
+		err = revokeUserSessions(db, username)
+	}
+	switch err {
+	case nil:
+		return c.SendStatus(204)
+	case ErrKeyNotFound:
+		return c.Status(404).JSON(fiber.Map{
+			"error": "User not found",
+		})
+	case ErrLastAdmin:
+		return c.Status(409).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	default:
+		return c.Status(500).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+}
+
+// changeOwnPassword lets a logged in user change their password. The current
+// password is required even though the request is already authenticated.
+func changeOwnPassword(c *fiber.Ctx) error {
+	db := serverOf(c).db
+	auth, err := auth(c)
+	if errors.Is(err, ErrFooForbidden) {
+		return c.Status(403).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+	if err != nil && err != ErrFooUnauthorized {
+		return c.Status(500).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+	if err == ErrFooUnauthorized {
+		return c.SendStatus(401)
+	}
+	if auth.Username == "" {
+		return c.Status(403).JSON(fiber.Map{
+			"error": "Only users can change their password",
+		})
+	}
+
+	type request struct {
+		OldPassword string
+		Password    string
+	}
+	var req request
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(400).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+	if err := validUser(auth.Username, req.Password); err != nil {
+		return c.Status(400).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+	if _, ok, err := checkUserPassword(db, auth.Username, req.OldPassword); err != nil || !ok {
+		if err != nil {
+			return c.Status(500).JSON(fiber.Map{
+				"error": err.Error(),
+			})
+		}
+		return c.Status(403).JSON(fiber.Map{
+			"error": "OldPassword is wrong",
+		})
+	}
+	hash, err := hashPassword(req.Password)
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+	if _, err := UpdateUser(db, auth.Username, func(u *User) error {
+		u.Hash, u.Updated = hash, time.Now().UTC()
+		return nil
+	}); err != nil {
+		return c.Status(500).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+	// 修改密码后其它已登录的会话全部失效
+	if err := revokeUserSessions(db, auth.Username); err != nil {
+		return c.Status(500).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+	return c.SendStatus(204)
+}
+
+// whoami returns how the request was authenticated and what it may do.
+func whoami(c *fiber.Ctx) error {
+	auth, err := auth(c)
+	if errors.Is(err, ErrFooForbidden) {
+		return c.Status(403).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+	if err != nil && err != ErrFooUnauthorized {
+		return c.Status(500).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+	if err == ErrFooUnauthorized {
+		return c.SendStatus(401)
+	}
+
+	scopes := auth.Scopes
+	if auth.IsAdmin {
+		scopes = []string{scopeAll}
+	} else if scopes == nil {
+		scopes = []string{}
+	}
+	info := fiber.Map{
+		"actor":  auth.Actor,
+		"admin":  auth.IsAdmin,
+		"scopes": scopes,
+	}
+	if auth.Username != "" {
+		info["username"] = auth.Username
+		info["role"] = auth.Role
+	}
+	if auth.KeyID != "" {
+		info["keyId"] = auth.KeyID
+	}
+	return c.Status(200).JSON(info)
+}
+
+// login exchanges a username and password for an access token and a refresh
+// token.
+func login(c *fiber.Ctx) error {
+	type request struct {
+		Username string
+		Password string
+	}
+	var req request
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(400).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+	if req.Username == "" || req.Password == "" {
+		return c.Status(400).JSON(fiber.Map{
+			"error": "Username and Password are required",
+		})
+	}
+
+	srv := serverOf(c)
+	keys := authLockoutKeys(c, req.Username)
+	if d := srv.lockedFor(keys...); d > 0 {
+		return lockedOut(c, d)
+	}
+	u, ok, err := checkPasswordFrom(c, req.Username, req.Password)
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+	if !ok {
+		return c.Status(401).JSON(fiber.Map{
+			"error": "Invalid username or password",
+		})
+	}
+	srv.clearAuthFailures(userLockoutKey(u.Username))
+	setActor(c, "user:"+u.Username)
+
+	sid, err := newSessionID()
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+	now := time.Now().UTC()
+	sess := Session{
+		ID:       sid,
+		Username: u.Username,
+		Created:  now,
+		Expiry:   now.Add(srv.Auth.RefreshTokenTTL),
+	}
+	return sendTokens(c, u, sess)
+}
+
+// refreshLogin trades a refresh token for a new access token and a new
+// refresh token; the old refresh token stops working.
+func refreshLogin(c *fiber.Ctx) error {
+	db := serverOf(c).db
+	type request struct {
+		RefreshToken string
+	}
+	var req request
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(400).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+
+	sess, err := lookupSession(db, req.RefreshToken)
+	if err == ErrKeyNotFound {
+		serverOf(c).recordAuthFailure(clientLockoutKey(c))
+		return c.Status(401).JSON(fiber.Map{
+			"error": "Invalid or expired refresh token",
+		})
+	}
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+	u, err := GetUser(db, sess.Username)
+	if err != nil && err != ErrKeyNotFound {
+		return c.Status(500).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+	setActor(c, "user:"+sess.Username)
+	if err == ErrKeyNotFound || u.Disabled {
+		if err := DeleteSession(db, sess.ID); err != nil && err != ErrKeyNotFound {
+			return c.Status(500).JSON(fiber.Map{
+				"error": err.Error(),
+			})
+		}
+		return c.Status(401).JSON(fiber.Map{
+			"error": "Invalid or expired refresh token",
+		})
+	}
+	return sendTokens(c, u, sess)
+}
+
+func sendTokens(c *fiber.Ctx, u User, sess Session) error {
+	srv := serverOf(c)
+	ttl := srv.Auth.AccessTokenTTL
+	access, refresh, err := srv.issueTokens(u, sess, ttl)
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+	return c.Status(200).JSON(fiber.Map{
+		"accessToken":      access,
+		"tokenType":        "Bearer",
+		"expiresIn":        int(ttl.Seconds()),
+		"refreshToken":     refresh,
+		"refreshExpiresIn": int(time.Until(sess.Expiry).Seconds()),
+		"username":         u.Username,
+		"role":             u.Role,
+	})
+}
+
+// logout ends the session of a refresh token. Access tokens issued for it
+// stop working as well.
+func logout(c *fiber.Ctx) error {
+	db := serverOf(c).db
+	type request struct {
+		RefreshToken string
+	}
+	var req request
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(400).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+
+	sess, err := lookupSession(db, req.RefreshToken)
+	if err == ErrKeyNotFound {
+		return c.Status(401).JSON(fiber.Map{
+			"error": "Invalid or expired refresh token",
+		})
+	}
+	if err == nil {
+		setActor(c, "user:"+sess.Username)
+		err = DeleteSession(db, sess.ID)
+	}
+	if err != nil && err != ErrKeyNotFound {
+		return c.Status(500).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+	return c.SendStatus(204)
+}
+
+// getAudit lists audit log entries, newest first. from and to are RFC 3339
+// times; actor and bucket filter on exact matches.
+func getAudit(c *fiber.Ctx) error {
+	db := serverOf(c).db
+	auth, err := auth(c)
+	if errors.Is(err, ErrFooForbidden) {
+		return c.Status(403).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+	if err != nil && err != ErrFooUnauthorized {
+		return c.Status(500).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+	if err == ErrFooUnauthorized {
+		return c.SendStatus(401)
+	}
+	if !auth.IsAdmin {
+		return c.SendStatus(403)
+	}
+
+	var from, to time.Time
+	for name, t := range map[string]*time.Time{"from": &from, "to": &to} {
+		v := c.Query(name)
+		if v == "" {
+			continue
+		}
+		if *t, err = time.Parse(time.RFC3339, v); err != nil {
+			return c.Status(400).JSON(fiber.Map{
+				"error": fmt.Sprintf("Invalid %s! (must be an RFC 3339 time like 2006-01-02T15:04:05Z)", name),
+			})
+		}
+	}
+	limit := c.QueryInt("limit", 100)
+	if limit <= 0 || limit > 1000 {
+		return c.Status(400).JSON(fiber.Map{
+			"error": "Invalid limit! (must be 1-1000)",
+		})
+	}
+	actor, bucket := c.Query("actor"), c.Query("bucket")
+
+	entries := []AuditEntry{}
+	err = ListAudit(db, from, to, func(e AuditEntry) bool {
+		if (actor == "" || e.Actor == actor) && (bucket == "" || e.Bucket == bucket) {
+			entries = append(entries, e)
+		}
+		return len(entries) < limit
+	})
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+	return c.Status(200).JSON(fiber.Map{
+		"entries": entries,
+		"total":   len(entries),
+	})
+}
+
+// listAuthLockouts shows the IPs and usernames with recent authentication
+// failures and whether they are locked out.
+func listAuthLockouts(c *fiber.Ctx) error {
+	auth, err := auth(c)
+	if errors.Is(err, ErrFooForbidden) {
+		return c.Status(403).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+	if err != nil && err != ErrFooUnauthorized {
+		return c.Status(500).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+	if err == ErrFooUnauthorized {
+		return c.SendStatus(401)
+	}
+	if !auth.IsAdmin {
+		return c.SendStatus(403)
+	}
+
+	list := serverOf(c).listLockouts()
+	locked := 0
+	for _, e := range list {
+		if e.LockedUntil.After(time.Now()) {
+			locked++
+		}
+	}
+	return c.Status(200).JSON(fiber.Map{
+		"entries": list,
+		"total":   len(list),
+		"locked":  locked,
+	})
+}
+
+// clearAuthLockouts lifts the lockout of one key ("ip:<addr>" or
+// "user:<name>") or, without a key, of everyone.
+func clearAuthLockouts(c *fiber.Ctx) error {
+	auth, err := auth(c)
+	if errors.Is(err, ErrFooForbidden) {
+		return c.Status(403).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+	if err != nil && err != ErrFooUnauthorized {
+		return c.Status(500).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+	if err == ErrFooUnauthorized {
+		return c.SendStatus(401)
+	}
+	if !auth.IsAdmin {
+		return c.SendStatus(403)
+	}
+
+	key, err := url.PathUnescape(c.Params("key"))
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+	n := serverOf(c).unlock(key)
+	if key != "" && n == 0 {
+		return c.Status(404).JSON(fiber.Map{
+			"error": "No failures recorded for " + key,
+		})
+	}
+	log.Printf("%s cleared %d lockout entries", auth.Actor, n)
+	return c.Status(200).JSON(fiber.Map{
+		"cleared": n,
+	})
+}
@@ -0,0 +1,112 @@
+package bolt
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"path"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// ---------------- Scopes ----------------
+//
+// API keys may carry scopes that limit what they can do:
+//
+//	read:<bucket glob>   read keys, scan, count and info of matching buckets
+//	write:<bucket glob>  put, bulk insert and delete keys in matching buckets
+//	seq:<name glob>      use the matching named sequences
+//	manage:buckets       create, rename and drop buckets; a rename also
+//	                     needs read and write on the old name and write on
+//	                     the new one, so data cannot be moved out of scope
+//	id:<kind glob>       generate ids of the matching kinds
+//	*                    everything an API key can do
+//
+// Globs use path.Match syntax, e.g. "events/*"; a lone "*" matches every
+// name. A key without scopes can do nothing. Keys created before scopes
+// existed are read as "*", see APIKey.UnmarshalJSON.
+//
+// Users get the scopes of their role, admins are not restricted.
+
+const (
+	scopeManageBuckets = "manage:buckets"
+	scopeAll           = "*"
+)
+
+var ErrFooForbidden = errors.New("forbidden")
+
+var roleScopes = map[string][]string{
+	RoleAdmin:  nil,
+	RoleEditor: {"read:*", "write:*", "seq:*", "id:*", scopeManageBuckets},
+	RoleViewer: {"read:*"},
+}
+
+func validRole(role string) bool {
+	_, ok := roleScopes[role]
+	return ok
+}
+
+// validScope reports whether s is a scope a key can be created with.
+func validScope(s string) error {
+	if s == scopeManageBuckets || s == scopeAll {
+		return nil
+	}
+	kind, glob, ok := strings.Cut(s, ":")
+	if !ok || glob == "" || (kind != "read" && kind != "write" && kind != "seq" && kind != "id") {
+		return fmt.Errorf("invalid scope %q, want read:, write:, seq: or id: followed by a glob, %s or %s", s, scopeManageBuckets, scopeAll)
+	}
+	if _, err := path.Match(glob, ""); err != nil {
+		return fmt.Errorf("invalid scope %q: %v", s, err)
+	}
+	return nil
+}
+
+// Can reports whether the caller may use scope, e.g. "read:orders".
+func (a AuthResult) Can(scope string) bool {
+	if a.IsAdmin {
+		return true
+	}
+	kind, name, _ := strings.Cut(scope, ":")
+	for _, s := range a.Scopes {
+		if s == scope || s == scopeAll {
+			return true
+		}
+		k, glob, _ := strings.Cut(s, ":")
+		if k == kind && kind != "manage" {
+			if ok, _ := path.Match(glob, name); ok || glob == "*" {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// canSeeBucket reports whether the bucket shows up in bucket listings.
+func (a AuthResult) canSeeBucket(name string) bool {
+	return a.Can(scopeManageBuckets) || a.Can(bucketScope("read", name)) || a.Can(bucketScope("write", name))
+}
+
+// bucketScope builds the scope for a bucket name taken from the URL path.
+func bucketScope(action, bucketName string) string {
+	if name, err := url.PathUnescape(bucketName); err == nil {
+		bucketName = name
+	}
+	return action + ":" + bucketName
+}
+
+// authorize authenticates the request like auth and then checks that every
+// one of scopes is granted. The first missing scope is reported as an error
+// wrapping ErrFooForbidden that names it.
+func authorize(c *fiber.Ctx, scopes ...string) (AuthResult, error) {
+	res, err := auth(c)
+	if err != nil {
+		return res, err
+	}
+	for _, scope := range scopes {
+		if !res.Can(scope) {
+			return res, fmt.Errorf("%w: %s lacks scope %q", ErrFooForbidden, res.Actor, scope)
+		}
+	}
+	return res, nil
+}
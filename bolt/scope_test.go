@@ -0,0 +1,138 @@
+package bolt
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestCan(t *testing.T) {
+	tests := []struct {
+		scopes []string
+		admin  bool
+		scope  string
+		want   bool
+	}{
+		{scopes: nil, scope: "read:events", want: false},
+		{scopes: nil, admin: true, scope: "manage:buckets", want: true},
+		{scopes: []string{"*"}, scope: "manage:buckets", want: true},
+		{scopes: []string{"*"}, scope: "write:a/b", want: true},
+		{scopes: []string{"read:*"}, scope: "read:a/b", want: true},
+		{scopes: []string{"read:*"}, scope: "write:a", want: false},
+		{scopes: []string{"read:events"}, scope: "read:events", want: true},
+		{scopes: []string{"read:events"}, scope: "read:events2", want: false},
+		{scopes: []string{"read:events/*"}, scope: "read:events/a", want: true},
+		{scopes: []string{"read:events/*"}, scope: "read:events/a/b", want: false},
+		{scopes: []string{"read:events/*"}, scope: "read:events", want: false},
+		{scopes: []string{"read:events/*"}, scope: "write:events/a", want: false},
+		{scopes: []string{"read:ev?nts"}, scope: "read:events", want: true},
+		{scopes: []string{"read:[ab]*"}, scope: "read:alpha", want: true},
+		{scopes: []string{"read:[ab]*"}, scope: "read:cat", want: false},
+		{scopes: []string{"seq:orders-*"}, scope: "seq:orders-2024", want: true},
+		{scopes: []string{"seq:orders-*"}, scope: "id:orders-2024", want: false},
+		{scopes: []string{"manage:buckets"}, scope: "manage:buckets", want: true},
+		{scopes: []string{"manage:*"}, scope: "manage:buckets", want: false},
+		{scopes: []string{"write:a", "read:b*"}, scope: "read:bee", want: true},
+	}
+	for _, tt := range tests {
+		a := AuthResult{IsAdmin: tt.admin, Scopes: tt.scopes}
+		if got := a.Can(tt.scope); got != tt.want {
+			t.Errorf("%v (admin %v) Can(%q) = %v, want %v", tt.scopes, tt.admin, tt.scope, got, tt.want)
+		}
+	}
+}
+
+func TestValidScope(t *testing.T) {
+	tests := []struct {
+		scope string
+		ok    bool
+	}{
+		{"*", true},
+		{"manage:buckets", true},
+		{"read:*", true},
+		{"write:events/*", true},
+		{"seq:orders-?", true},
+		{"id:ulid", true},
+		{"read:", false},
+		{"read", false},
+		{"delete:events", false},
+		{"manage:*", false},
+		{"read:[", false},
+	}
+	for _, tt := range tests {
+		if err := validScope(tt.scope); (err == nil) != tt.ok {
+			t.Errorf("validScope(%q) = %v, want ok %v", tt.scope, err, tt.ok)
+		}
+	}
+}
+
+func TestBucketScope(t *testing.T) {
+	if got := bucketScope("read", "events%2Fa"); got != "read:events/a" {
+		t.Errorf("bucketScope of an escaped name = %q", got)
+	}
+	if got := bucketScope("write", "100%"); got != "write:100%" {
+		t.Errorf("bucketScope of an invalid escape = %q", got)
+	}
+}
+
+// TestScopedRequests checks that handlers ask for the right scopes.
+func TestScopedRequests(t *testing.T) {
+	app, srv := newTestApp(t, nil)
+	for _, name := range []string{"events", "events2", "orders"} {
+		if err := PutKV(srv.db, metadataBucket, name, "string"); err != nil {
+			t.Fatal(err)
+		}
+		if err := CreateBucket(srv.db, name); err != nil {
+			t.Fatal(err)
+		}
+		if err := PutKV(srv.db, name, "k", "v"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	key := func(scopes ...string) string {
+		return newTestAPIKey(t, srv.db, APIKey{Scopes: scopes})
+	}
+	var (
+		none     = key()
+		readEv   = key("read:ev*")
+		writeAll = key("write:*")
+		all      = key("*")
+		mover    = key("manage:buckets", "read:events2", "write:events2", "write:archive")
+		noRead   = key("manage:buckets", "write:*")
+		noTarget = key("manage:buckets", "read:*", "write:orders")
+	)
+
+	tests := []struct {
+		name   string
+		token  string
+		method string
+		path   string
+		want   int
+	}{
+		{"no scopes", none, "GET", "/kv/get/events/k", 403},
+		{"read glob", readEv, "GET", "/kv/get/events/k", 200},
+		{"read glob, other bucket", readEv, "GET", "/kv/get/orders/k", 403},
+		{"read glob, count", readEv, "GET", "/kv/count/events2", 200},
+		{"read only, delete", readEv, "DELETE", "/kv/events/k", 403},
+		{"read only, create bucket", readEv, "POST", "/bucket/evnew/string", 403},
+		{"write only, read", writeAll, "GET", "/kv/get/events/k", 403},
+		{"write, delete", writeAll, "DELETE", "/kv/orders/k", 204},
+		{"write only, drop bucket", writeAll, "DELETE", "/bucket/orders", 403},
+		{"everything", all, "GET", "/kv/get/events/k", 200},
+		{"rename without read on the source", noRead, "PUT", "/bucket/events2/archive", 403},
+		{"rename without write on the target", noTarget, "PUT", "/bucket/orders/archive", 403},
+		{"rename", mover, "PUT", "/bucket/events2/archive", 204},
+		{"renamed bucket", all, "GET", "/kv/count/archive", 200},
+		{"read glob, renamed bucket", readEv, "GET", "/kv/count/archive", 403},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(tt.method, tt.path, nil)
+		req.Header.Set("Authorization", tt.token)
+		resp, err := app.Test(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.StatusCode != tt.want {
+			t.Errorf("%s: %s %s = %d, want %d", tt.name, tt.method, tt.path, resp.StatusCode, tt.want)
+		}
+	}
+}
@@ -0,0 +1,135 @@
+package bolt
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"strconv"
+	"sync"
+	"time"
+
+	bolt "github.com/boltdb/bolt"
+	"github.com/gofiber/fiber/v2"
+)
+
+// ---------------- Signed Requests ----------------
+//
+// API keys created with Signing never travel over the wire. The client gets
+// a signing key for the key id once, signs
+//
+//	METHOD \n URI \n TIMESTAMP \n NONCE \n hex(sha256(BODY))
+//
+// with HMAC-SHA256 and sends the id, timestamp, nonce and hex signature in
+// the X-Boltbase-* headers. URI is the path with the raw query string. The
+// signing key is derived from a server secret, so it is not stored with the
+// key record. Requests outside Auth.SignatureWindow or reusing a nonce are
+// rejected; nonces are remembered in memory for as long as their timestamp
+// is acceptable.
+
+const (
+	headerKeyID     = "X-Boltbase-Key"
+	headerTimestamp = "X-Boltbase-Timestamp"
+	headerNonce     = "X-Boltbase-Nonce"
+	headerSignature = "X-Boltbase-Signature"
+
+	signingSecretName = "apikey-signing"
+	maxNonceLen       = 128
+)
+
+type nonceTable struct {
+	mu    sync.Mutex
+	until map[string]time.Time // "<id>|<nonce>" -> when it may be forgotten
+}
+
+func newNonceTable() *nonceTable {
+	return &nonceTable{until: make(map[string]time.Time)}
+}
+
+// apiKeySigningKey returns the signing key of the API key id.
+func apiKeySigningKey(db *bolt.DB, id string) (string, error) {
+	secret, err := GetSecret(db, signingSecretName, 32)
+	if err != nil {
+		return "", err
+	}
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte("boltbase-request-signing:" + id))
+	return hex.EncodeToString(mac.Sum(nil)), nil
+}
+
+// stringToSign is what the client signs for the request.
+func stringToSign(c *fiber.Ctx, timestamp, nonce string) string {
+	sum := sha256.Sum256(c.Body())
+	return c.Method() + "\n" + c.OriginalURL() + "\n" + timestamp + "\n" + nonce + "\n" + hex.EncodeToString(sum[:])
+}
+
+// isSignedRequest reports whether the request carries a signature instead of
+// an API key.
+func isSignedRequest(c *fiber.Ctx) bool {
+	return c.Get(headerSignature) != ""
+}
+
+// verifySignedRequest checks the signature headers and returns the signing
+// API key. Anything wrong with the request yields ErrKeyNotFound.
+func verifySignedRequest(c *fiber.Ctx) (APIKey, error) {
+	id, timestamp, nonce := c.Get(headerKeyID), c.Get(headerTimestamp), c.Get(headerNonce)
+	sig, err := hex.DecodeString(c.Get(headerSignature))
+	if err != nil || id == "" || nonce == "" || len(nonce) > maxNonceLen {
+		return APIKey{}, ErrKeyNotFound
+	}
+	ts, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return APIKey{}, ErrKeyNotFound
+	}
+	signedAt, now := time.Unix(ts, 0), time.Now()
+	s := serverOf(c)
+	window := s.Auth.SignatureWindow
+	if signedAt.Before(now.Add(-window)) || signedAt.After(now.Add(window)) {
+		return APIKey{}, ErrKeyNotFound
+	}
+
+	key, err := GetAPIKey(s.db, id)
+	if err != nil {
+		return APIKey{}, err
+	}
+	if !key.Signing {
+		return APIKey{}, ErrKeyNotFound
+	}
+	signingKey, err := apiKeySigningKey(s.db, id)
+	if err != nil {
+		return APIKey{}, err
+	}
+	mac := hmac.New(sha256.New, []byte(signingKey))
+	mac.Write([]byte(stringToSign(c, timestamp, nonce)))
+	if !hmac.Equal(sig, mac.Sum(nil)) {
+		return APIKey{}, ErrKeyNotFound
+	}
+
+	// 签名正确之后才记录 nonce，伪造的请求不能占用别人的 nonce
+	if !s.useNonce(id+"|"+nonce, signedAt.Add(window)) {
+		return APIKey{}, ErrKeyNotFound
+	}
+	return key, nil
+}
+
+// useNonce records nonce and reports whether it was new.
+func (s *server) useNonce(nonce string, until time.Time) bool {
+	s.nonces.mu.Lock()
+	defer s.nonces.mu.Unlock()
+	if _, seen := s.nonces.until[nonce]; seen {
+		return false
+	}
+	s.nonces.until[nonce] = until
+	return true
+}
+
+// pruneNonces forgets nonces whose timestamp is outside the window anyway.
+func (s *server) pruneNonces() {
+	now := time.Now()
+	s.nonces.mu.Lock()
+	defer s.nonces.mu.Unlock()
+	for nonce, until := range s.nonces.until {
+		if now.After(until) {
+			delete(s.nonces.until, nonce)
+		}
+	}
+}
@@ -0,0 +1,184 @@
+package bolt
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// signedRequest builds a request signed the way the README tells clients
+// to, independently of stringToSign.
+func signedRequest(method, uri, body, id, signingKey string, ts time.Time, nonce string) *http.Request {
+	sum := sha256.Sum256([]byte(body))
+	msg := method + "\n" + uri + "\n" + strconv.FormatInt(ts.Unix(), 10) + "\n" + nonce + "\n" + hex.EncodeToString(sum[:])
+	mac := hmac.New(sha256.New, []byte(signingKey))
+	mac.Write([]byte(msg))
+
+	req := httptest.NewRequest(method, uri, strings.NewReader(body))
+	req.Header.Set(headerKeyID, id)
+	req.Header.Set(headerTimestamp, strconv.FormatInt(ts.Unix(), 10))
+	req.Header.Set(headerNonce, nonce)
+	req.Header.Set(headerSignature, hex.EncodeToString(mac.Sum(nil)))
+	return req
+}
+
+func TestSignedRequests(t *testing.T) {
+	app, srv := newTestApp(t, nil)
+	token := newTestAPIKey(t, srv.db, APIKey{Scopes: []string{"read:*"}, Signing: true})
+	id := apiKeyIDs(token)[0]
+	key, err := apiKeySigningKey(srv.db, id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	plain := newTestAPIKey(t, srv.db, APIKey{Scopes: []string{"read:*"}})
+	plainKey, err := apiKeySigningKey(srv.db, apiKeyIDs(plain)[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	window := srv.Auth.SignatureWindow
+	now := time.Now()
+	tests := []struct {
+		name string
+		req  func(nonce string) *http.Request
+		want int
+	}{
+		{"valid", func(n string) *http.Request {
+			return signedRequest("GET", "/bucket", "", id, key, now, n)
+		}, 200},
+		{"valid with query", func(n string) *http.Request {
+			return signedRequest("GET", "/bucket?x=1&y=2", "", id, key, now, n)
+		}, 200},
+		{"query not signed", func(n string) *http.Request {
+			req := signedRequest("GET", "/bucket", "", id, key, now, n)
+			req.URL.RawQuery, req.RequestURI = "x=1", "/bucket?x=1"
+			return req
+		}, 401},
+		{"query reordered", func(n string) *http.Request {
+			req := signedRequest("GET", "/bucket?x=1&y=2", "", id, key, now, n)
+			req.URL.RawQuery, req.RequestURI = "y=2&x=1", "/bucket?y=2&x=1"
+			return req
+		}, 401},
+		{"other method", func(n string) *http.Request {
+			req := signedRequest("POST", "/bucket", "", id, key, now, n)
+			req.Method = "GET"
+			return req
+		}, 401},
+		// 认证通过但只有读权限
+		{"signed body", func(n string) *http.Request {
+			return signedRequest("POST", "/bucket/b/string", "body", id, key, now, n)
+		}, 403},
+		{"body changed", func(n string) *http.Request {
+			req := signedRequest("POST", "/bucket/b/string", "body", id, key, now, n)
+			req.Body = io.NopCloser(strings.NewReader("BODY"))
+			return req
+		}, 401},
+		{"other key's signing key", func(n string) *http.Request {
+			return signedRequest("GET", "/bucket", "", id, plainKey, now, n)
+		}, 401},
+		{"key without signing", func(n string) *http.Request {
+			return signedRequest("GET", "/bucket", "", apiKeyIDs(plain)[0], plainKey, now, n)
+		}, 401},
+		{"bad signature hex", func(n string) *http.Request {
+			req := signedRequest("GET", "/bucket", "", id, key, now, n)
+			req.Header.Set(headerSignature, "zz")
+			return req
+		}, 401},
+		{"missing nonce", func(string) *http.Request {
+			return signedRequest("GET", "/bucket", "", id, key, now, "")
+		}, 401},
+		{"nonce too long", func(string) *http.Request {
+			return signedRequest("GET", "/bucket", "", id, key, now, strings.Repeat("n", maxNonceLen+1))
+		}, 401},
+		{"just inside the window", func(n string) *http.Request {
+			return signedRequest("GET", "/bucket", "", id, key, now.Add(-window+5*time.Second), n)
+		}, 200},
+		{"too old", func(n string) *http.Request {
+			return signedRequest("GET", "/bucket", "", id, key, now.Add(-window-time.Second), n)
+		}, 401},
+		{"from the future", func(n string) *http.Request {
+			return signedRequest("GET", "/bucket", "", id, key, now.Add(window+time.Second), n)
+		}, 401},
+		{"timestamp not a number", func(n string) *http.Request {
+			req := signedRequest("GET", "/bucket", "", id, key, now, n)
+			req.Header.Set(headerTimestamp, "yesterday")
+			return req
+		}, 401},
+		{"signing key as api key", func(string) *http.Request {
+			req := httptest.NewRequest("GET", "/bucket", nil)
+			req.Header.Set("Authorization", token)
+			return req
+		}, 401},
+	}
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp, err := app.Test(tt.req("nonce-" + strconv.Itoa(i)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if resp.StatusCode != tt.want {
+				t.Errorf("status = %d, want %d", resp.StatusCode, tt.want)
+			}
+		})
+	}
+}
+
+func TestSignedRequestNonceReplay(t *testing.T) {
+	app, srv := newTestApp(t, nil)
+	var ids, keys []string
+	for range 2 {
+		token := newTestAPIKey(t, srv.db, APIKey{Scopes: []string{"read:*"}, Signing: true})
+		id := apiKeyIDs(token)[0]
+		key, err := apiKeySigningKey(srv.db, id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids, keys = append(ids, id), append(keys, key)
+	}
+
+	now := time.Now()
+	steps := []struct {
+		name  string
+		key   int
+		nonce string
+		want  int
+	}{
+		{"first use", 0, "n1", 200},
+		{"replayed", 0, "n1", 401},
+		{"new nonce", 0, "n2", 200},
+		{"same nonce, other key", 1, "n1", 200},
+		{"replayed again", 0, "n1", 401},
+	}
+	for _, s := range steps {
+		req := signedRequest("GET", "/bucket", "", ids[s.key], keys[s.key], now, s.nonce)
+		resp, err := app.Test(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.StatusCode != s.want {
+			t.Errorf("%s: status = %d, want %d", s.name, resp.StatusCode, s.want)
+		}
+	}
+
+	// 伪造的签名不能占用 nonce
+	forged := signedRequest("GET", "/bucket", "", ids[0], keys[1], now, "n3")
+	if resp, err := app.Test(forged); err != nil || resp.StatusCode != 401 {
+		t.Fatalf("forged request: %v, %v", resp.StatusCode, err)
+	}
+	real := signedRequest("GET", "/bucket", "", ids[0], keys[0], now, "n3")
+	if resp, err := app.Test(real); err != nil || resp.StatusCode != 200 {
+		t.Errorf("nonce of a forged request: %v, %v", resp.StatusCode, err)
+	}
+
+	srv.pruneNonces()
+	if n := len(srv.nonces.until); n != 4 {
+		t.Errorf("%d nonces left after pruning, want the 4 still inside the window", n)
+	}
+}
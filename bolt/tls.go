@@ -0,0 +1,154 @@
+package bolt
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"log"
+	"math/big"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// ---------------- TLS ----------------
+
+// tlsReloader holds the server certificate and the client CA pool so they can
+// be swapped on SIGHUP without restarting the listener.
+type tlsReloader struct {
+	cfg TLSConfig
+
+	mu       sync.RWMutex
+	cert     *tls.Certificate
+	clientCA *x509.CertPool
+}
+
+func newTLSReloader(cfg TLSConfig) (*tlsReloader, error) {
+	r := &tlsReloader{cfg: cfg}
+	if cfg.SelfSigned && cfg.CertFile == "" {
+		cert, err := selfSignedCert(cfg.SelfSignedHosts)
+		if err != nil {
+			return nil, err
+		}
+		r.cert = cert
+	}
+	return r, r.reload()
+}
+
+// reload re-reads the certificate, key and client CA files. On error the
+// previous material stays in use.
+func (r *tlsReloader) reload() error {
+	var (
+		cert *tls.Certificate
+		pool *x509.CertPool
+	)
+	if r.cfg.CertFile != "" {
+		c, err := tls.LoadX509KeyPair(r.cfg.CertFile, r.cfg.KeyFile)
+		if err != nil {
+			return err
+		}
+		cert = &c
+	}
+	if r.cfg.ClientCAFile != "" {
+		pem, err := os.ReadFile(r.cfg.ClientCAFile)
+		if err != nil {
+			return err
+		}
+		pool = x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return errors.New("no certificates found in " + r.cfg.ClientCAFile)
+		}
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if cert != nil {
+		r.cert = cert
+	}
+	r.clientCA = pool
+	return nil
+}
+
+func (r *tlsReloader) tlsConfig() *tls.Config {
+	clientAuth := tls.NoClientCert
+	switch r.cfg.ClientAuth {
+	case "request":
+		clientAuth = tls.VerifyClientCertIfGiven
+	case "require":
+		clientAuth = tls.RequireAndVerifyClientCert
+	}
+
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			r.mu.RLock()
+			defer r.mu.RUnlock()
+			return &tls.Config{
+				MinVersion:   tls.VersionTLS12,
+				Certificates: []tls.Certificate{*r.cert},
+				ClientAuth:   clientAuth,
+				ClientCAs:    r.clientCA,
+			}, nil
+		},
+	}
+}
+
+// selfSignedCert creates an in-memory certificate for local development.
+func selfSignedCert(hosts []string) (*tls.Certificate, error) {
+	if len(hosts) == 0 {
+		hosts = []string{"localhost", "127.0.0.1", "::1"}
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, err
+	}
+	tmpl := x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: hosts[0], Organization: []string{"Boltbase self-signed"}},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().AddDate(1, 0, 0),
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+	}
+	for _, h := range hosts {
+		if ip := net.ParseIP(h); ip != nil {
+			tmpl.IPAddresses = append(tmpl.IPAddresses, ip)
+		} else {
+			tmpl.DNSNames = append(tmpl.DNSNames, h)
+		}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &tmpl, &tmpl, &key.PublicKey, key)
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("Using a self-signed TLS certificate for %v", hosts)
+	return &tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, nil
+}
+
+// clientCertRole maps the verified client certificate of the request, if any,
+// to a role from TLSConfig.ClientRoles. The common name is tried first, then
+// the full subject (e.g. "CN=svc,O=acme"). The matched name is returned too.
+func clientCertRole(c *fiber.Ctx) (role, name string) {
+	state := c.Context().TLSConnectionState()
+	if state == nil || len(state.VerifiedChains) == 0 || len(state.VerifiedChains[0]) == 0 {
+		return "", ""
+	}
+	subject := state.VerifiedChains[0][0].Subject
+	roles := serverOf(c).TLS.ClientRoles
+	if role, ok := roles[subject.CommonName]; ok {
+		return role, subject.CommonName
+	}
+	return roles[subject.String()], subject.String()
+}
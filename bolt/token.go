@@ -0,0 +1,284 @@
+package bolt
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	bolt "github.com/boltdb/bolt"
+)
+
+// ---------------- Login Tokens ----------------
+//
+// POST /auth/login trades a username and password for a short-lived access
+// token (an HS256 JWT sent as "Authorization: Bearer ...") and a refresh
+// token. The refresh token names a session record; logging out or revoking
+// the user deletes the session, which also invalidates every access token
+// issued for it.
+
+const (
+	refreshTokenPrefix = "bbr_"
+	tokenSecretName    = "jwt-hs256"
+)
+
+// jwtHeader is the only header accepted: {"alg":"HS256","typ":"JWT"}.
+var jwtHeader = base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"HS256","typ":"JWT"}`))
+
+var errBadToken = errors.New("invalid token")
+
+type tokenClaims struct {
+	Sub  string `json:"sub"`
+	Role string `json:"role"`
+	Sid  string `json:"sid"`
+	Iat  int64  `json:"iat"`
+	Exp  int64  `json:"exp"`
+}
+
+type tokenKeyCache struct {
+	mu  sync.Mutex
+	key []byte
+}
+
+// signingKey returns the server secret used to sign access tokens. It is
+// generated on first use and kept in the secret bucket so tokens survive a
+// restart.
+func (s *server) signingKey() ([]byte, error) {
+	s.tokenKey.mu.Lock()
+	defer s.tokenKey.mu.Unlock()
+	if s.tokenKey.key != nil {
+		return s.tokenKey.key, nil
+	}
+	key, err := GetSecret(s.db, tokenSecretName, 32)
+	if err != nil {
+		return nil, err
+	}
+	s.tokenKey.key = key
+	return key, nil
+}
+
+func (s *server) signAccessToken(claims tokenClaims) (string, error) {
+	key, err := s.signingKey()
+	if err != nil {
+		return "", err
+	}
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+	msg := jwtHeader + "." + base64.RawURLEncoding.EncodeToString(payload)
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(msg))
+	return msg + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil)), nil
+}
+
+// parseAccessToken checks the signature and expiry of an access token.
+func (s *server) parseAccessToken(token string) (tokenClaims, error) {
+	var claims tokenClaims
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 || parts[0] != jwtHeader {
+		return claims, errBadToken
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return claims, errBadToken
+	}
+	key, err := s.signingKey()
+	if err != nil {
+		return claims, err
+	}
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(parts[0] + "." + parts[1]))
+	if !hmac.Equal(sig, mac.Sum(nil)) {
+		return claims, errBadToken
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil || json.Unmarshal(payload, &claims) != nil {
+		return claims, errBadToken
+	}
+	if claims.Sub == "" || claims.Sid == "" || time.Now().Unix() >= claims.Exp {
+		return claims, errBadToken
+	}
+	return claims, nil
+}
+
+// parseBearer extracts the token from an "Authorization: Bearer ..." header.
+func parseBearer(header string) (string, bool) {
+	const prefix = "bearer "
+	if len(header) < len(prefix) || !strings.EqualFold(header[:len(prefix)], prefix) {
+		return "", false
+	}
+	return strings.TrimSpace(header[len(prefix):]), true
+}
+
+// newRefreshToken returns bbr_<sid>_<secret>.
+func newRefreshToken(sid string) (string, error) {
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return refreshTokenPrefix + sid + "_" + base64.RawURLEncoding.EncodeToString(buf), nil
+}
+
+func newSessionID() (string, error) {
+	buf := make([]byte, 8)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(buf), nil
+}
+
+// refreshSessionID extracts the session id from a refresh token.
+func refreshSessionID(token string) (string, bool) {
+	rest, ok := strings.CutPrefix(token, refreshTokenPrefix)
+	if !ok {
+		return "", false
+	}
+	sid, _, ok := strings.Cut(rest, "_")
+	return sid, ok && sid != ""
+}
+
+// issueTokens creates an access token for u bound to sess, valid for ttl,
+// and stores sess with the hash of a fresh refresh token.
+func (s *server) issueTokens(u User, sess Session, ttl time.Duration) (access, refresh string, err error) {
+	if refresh, err = newRefreshToken(sess.ID); err != nil {
+		return "", "", err
+	}
+	sess.Hash = hashAPIKey(refresh)
+	if err = PutSession(s.db, sess); err != nil {
+		return "", "", err
+	}
+	now := time.Now()
+	access, err = s.signAccessToken(tokenClaims{
+		Sub:  u.Username,
+		Role: u.Role,
+		Sid:  sess.ID,
+		Iat:  now.Unix(),
+		Exp:  now.Add(ttl).Unix(),
+	})
+	return access, refresh, err
+}
+
+// lookupSession finds the live session for a refresh token. A well-formed
+// token whose secret does not match has already been used: the session is
+// revoked since either the client or an attacker holds a stolen copy.
+func lookupSession(db *bolt.DB, token string) (Session, error) {
+	sid, ok := refreshSessionID(token)
+	if !ok {
+		return Session{}, ErrKeyNotFound
+	}
+	sess, err := GetSession(db, sid)
+	if err != nil {
+		return Session{}, err
+	}
+	if sess.Web {
+		return Session{}, ErrKeyNotFound
+	}
+	if subtle.ConstantTimeCompare([]byte(sess.Hash), []byte(hashAPIKey(token))) != 1 {
+		if err := DeleteSession(db, sid); err != nil && err != ErrKeyNotFound {
+			return Session{}, err
+		}
+		return Session{}, ErrKeyNotFound
+	}
+	if !sess.Expiry.After(time.Now()) {
+		return Session{}, ErrKeyNotFound
+	}
+	return sess, nil
+}
+
+// newWebSession stores a web console session for u that lasts ttl and
+// returns the cookie value. Unlike refresh tokens the value stays the same
+// for the whole session.
+func newWebSession(db *bolt.DB, u User, ttl time.Duration) (string, Session, error) {
+	sid, err := newSessionID()
+	if err != nil {
+		return "", Session{}, err
+	}
+	token, err := newRefreshToken(sid)
+	if err != nil {
+		return "", Session{}, err
+	}
+	now := time.Now().UTC()
+	sess := Session{
+		ID:       sid,
+		Username: u.Username,
+		Hash:     hashAPIKey(token),
+		Web:      true,
+		Created:  now,
+		Expiry:   now.Add(ttl),
+	}
+	return token, sess, PutSession(db, sess)
+}
+
+// webSessionUser resolves a session cookie to its (still enabled) user.
+func webSessionUser(db *bolt.DB, token string) (User, Session, error) {
+	sid, ok := refreshSessionID(token)
+	if !ok {
+		return User{}, Session{}, ErrKeyNotFound
+	}
+	sess, err := GetSession(db, sid)
+	if err != nil {
+		return User{}, Session{}, err
+	}
+	if !sess.Web || !sess.Expiry.After(time.Now()) ||
+		subtle.ConstantTimeCompare([]byte(sess.Hash), []byte(hashAPIKey(token))) != 1 {
+		return User{}, Session{}, ErrKeyNotFound
+	}
+	u, err := GetUser(db, sess.Username)
+	if err != nil {
+		return User{}, Session{}, err
+	}
+	if u.Disabled {
+		return User{}, Session{}, ErrKeyNotFound
+	}
+	return u, sess, nil
+}
+
+// bearerUser resolves an access token to its (still enabled) user. The
+// current role is used, not the one in the token, so demotions take effect
+// immediately.
+func (s *server) bearerUser(token string) (User, error) {
+	claims, err := s.parseAccessToken(token)
+	if err == errBadToken || err == ErrKeyNotFound {
+		return User{}, ErrKeyNotFound
+	}
+	if err != nil {
+		return User{}, err
+	}
+	sess, err := GetSession(s.db, claims.Sid)
+	if err != nil {
+		return User{}, err
+	}
+	if sess.Username != claims.Sub || !sess.Expiry.After(time.Now()) {
+		return User{}, ErrKeyNotFound
+	}
+	u, err := GetUser(s.db, claims.Sub)
+	if err != nil {
+		return User{}, err
+	}
+	if u.Disabled {
+		return User{}, ErrKeyNotFound
+	}
+	return u, nil
+}
+
+// revokeUserSessions logs out every session of username.
+func revokeUserSessions(db *bolt.DB, username string) error {
+	_, err := DeleteSessions(db, func(s Session) bool { return s.Username == username })
+	return err
+}
+
+func (s *server) deleteExpiredSessions() {
+	now := time.Now()
+	if _, err := DeleteSessions(s.db, func(s Session) bool { return !s.Expiry.After(now) }); err != nil {
+		log.Printf("Deleting expired sessions failed: %v", err)
+	}
+}
@@ -0,0 +1,147 @@
+package bolt
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+type testTokens struct {
+	AccessToken  string `json:"accessToken"`
+	RefreshToken string `json:"refreshToken"`
+}
+
+func postJSON(t *testing.T, path string, body any) *http.Request {
+	t.Helper()
+	data, err := json.Marshal(body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := httptest.NewRequest("POST", path, strings.NewReader(string(data)))
+	req.Header.Set("Content-Type", "application/json")
+	return req
+}
+
+func TestRefreshTokenReuse(t *testing.T) {
+	app, _ := newTestApp(t, nil)
+
+	call := func(req *http.Request) (int, testTokens) {
+		t.Helper()
+		resp, err := app.Test(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var tokens testTokens
+		json.NewDecoder(resp.Body).Decode(&tokens)
+		return resp.StatusCode, tokens
+	}
+	refresh := func(token string) (int, testTokens) {
+		return call(postJSON(t, "/auth/refresh", map[string]string{"refreshToken": token}))
+	}
+	bearer := func(token string) int {
+		req := httptest.NewRequest("GET", "/bucket", nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		code, _ := call(req)
+		return code
+	}
+
+	code, first := call(postJSON(t, "/auth/login", map[string]string{"username": "admin", "password": testPassword}))
+	if code != 200 || first.AccessToken == "" || first.RefreshToken == "" {
+		t.Fatalf("login: %d %+v", code, first)
+	}
+	if code := bearer(first.AccessToken); code != 200 {
+		t.Fatalf("access token: %d", code)
+	}
+
+	code, second := refresh(first.RefreshToken)
+	if code != 200 || second.RefreshToken == first.RefreshToken {
+		t.Fatalf("refresh: %d %+v", code, second)
+	}
+	if code := bearer(second.AccessToken); code != 200 {
+		t.Fatalf("refreshed access token: %d", code)
+	}
+
+	// 旧的 refresh token 再次出现说明它被复制过，整个会话作废
+	if code, _ := refresh(first.RefreshToken); code != 401 {
+		t.Errorf("reused refresh token: %d, want 401", code)
+	}
+	if code, _ := refresh(second.RefreshToken); code != 401 {
+		t.Errorf("current refresh token after reuse: %d, want 401", code)
+	}
+	for _, token := range []string{first.AccessToken, second.AccessToken} {
+		if code := bearer(token); code != 401 {
+			t.Errorf("access token after reuse: %d, want 401", code)
+		}
+	}
+
+	// 其他会话不受影响
+	_, other := call(postJSON(t, "/auth/login", map[string]string{"username": "admin", "password": testPassword}))
+	sid, _ := refreshSessionID(other.RefreshToken)
+	tests := []struct {
+		name  string
+		token string
+	}{
+		{"empty", ""},
+		{"no prefix", "garbage"},
+		{"no secret", "bbr_" + sid},
+		{"wrong secret", "bbr_" + sid + "_" + strings.Repeat("A", 43)},
+		{"unknown session", "bbr_0000000000000000_" + strings.Repeat("A", 43)},
+	}
+	for _, tt := range tests {
+		if code, _ := refresh(tt.token); code != 401 {
+			t.Errorf("%s: %d, want 401", tt.name, code)
+		}
+	}
+	// 秘密部分不对也算复用
+	if code, _ := refresh(other.RefreshToken); code != 401 {
+		t.Errorf("session after a wrong secret for it: %d, want 401", code)
+	}
+}
+
+func TestParseAccessToken(t *testing.T) {
+	_, srv := newTestApp(t, nil)
+	now := time.Now()
+	claims := tokenClaims{Sub: "admin", Role: RoleAdmin, Sid: "s1", Iat: now.Unix(), Exp: now.Add(time.Minute).Unix()}
+	valid, err := srv.signAccessToken(claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expiredClaims := claims
+	expiredClaims.Exp = now.Add(-time.Second).Unix()
+	expired, err := srv.signAccessToken(expiredClaims)
+	if err != nil {
+		t.Fatal(err)
+	}
+	parts := strings.Split(valid, ".")
+	enc := base64.RawURLEncoding.EncodeToString
+
+	tests := []struct {
+		name  string
+		token string
+		ok    bool
+	}{
+		{"valid", valid, true},
+		{"expired", expired, false},
+		{"payload changed", parts[0] + "." + enc([]byte(`{"sub":"root","role":"admin","sid":"s1","exp":9999999999}`)) + "." + parts[2], false},
+		{"alg none", enc([]byte(`{"alg":"none","typ":"JWT"}`)) + "." + parts[1] + ".", false},
+		{"signature dropped", parts[0] + "." + parts[1] + ".", false},
+		{"two parts", parts[0] + "." + parts[1], false},
+		{"empty", "", false},
+	}
+	for _, tt := range tests {
+		got, err := srv.parseAccessToken(tt.token)
+		if tt.ok {
+			if err != nil || got != claims {
+				t.Errorf("%s: %+v, %v", tt.name, got, err)
+			}
+			continue
+		}
+		if err != errBadToken {
+			t.Errorf("%s: err = %v, want errBadToken", tt.name, err)
+		}
+	}
+}
@@ -0,0 +1,154 @@
+package bolt
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"net"
+	"os"
+	"os/user"
+	"strconv"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// ---------------- Unix Socket ----------------
+
+// peerConn is a connection accepted on the unix socket together with the
+// credentials of the process on the other end (SO_PEERCRED).
+type peerConn struct {
+	net.Conn
+	uid, gid uint32
+	pid      int32
+	credOK   bool
+}
+
+type peerListener struct {
+	net.Listener
+}
+
+func (l peerListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	pc := &peerConn{Conn: conn}
+	if uc, ok := conn.(*net.UnixConn); ok {
+		pc.uid, pc.gid, pc.pid, err = peerCred(uc)
+		pc.credOK = err == nil
+	}
+	return pc, nil
+}
+
+// peerAdmins is UnixConfig.AdminPeers resolved to uids.
+type peerAdmins struct {
+	any  bool
+	uids map[uint32]bool
+}
+
+func resolvePeerAdmins(peers []string) (peerAdmins, error) {
+	admins := peerAdmins{uids: make(map[uint32]bool)}
+	for _, p := range peers {
+		if p == "*" {
+			admins.any = true
+			continue
+		}
+		uid, err := lookupID(p, false)
+		if err != nil {
+			return admins, err
+		}
+		admins.uids[uid] = true
+	}
+	return admins, nil
+}
+
+// listenUnix creates the unix socket with the configured mode and owner.
+func listenUnix(cfg UnixConfig) (net.Listener, error) {
+	if fi, err := os.Lstat(cfg.Path); err == nil {
+		if fi.Mode()&fs.ModeSocket == 0 {
+			return nil, fmt.Errorf("%s exists and is not a socket", cfg.Path)
+		}
+		// 上一次没有正常退出留下的 socket 文件
+		if err := os.Remove(cfg.Path); err != nil {
+			return nil, err
+		}
+	}
+
+	ln, err := net.Listen("unix", cfg.Path)
+	if err != nil {
+		return nil, err
+	}
+	if err := setupSocketFile(cfg); err != nil {
+		ln.Close()
+		return nil, err
+	}
+	return peerListener{ln}, nil
+}
+
+func setupSocketFile(cfg UnixConfig) error {
+	if cfg.Mode != "" {
+		mode, err := strconv.ParseUint(cfg.Mode, 8, 32)
+		if err != nil {
+			return fmt.Errorf("unix: invalid mode %q", cfg.Mode)
+		}
+		if err := os.Chmod(cfg.Path, fs.FileMode(mode)); err != nil {
+			return err
+		}
+	}
+	if cfg.Owner == "" && cfg.Group == "" {
+		return nil
+	}
+	uid, gid := -1, -1
+	if cfg.Owner != "" {
+		id, err := lookupID(cfg.Owner, false)
+		if err != nil {
+			return err
+		}
+		uid = int(id)
+	}
+	if cfg.Group != "" {
+		id, err := lookupID(cfg.Group, true)
+		if err != nil {
+			return err
+		}
+		gid = int(id)
+	}
+	return os.Chown(cfg.Path, uid, gid)
+}
+
+// lookupID accepts a numeric id or a user/group name.
+func lookupID(name string, group bool) (uint32, error) {
+	if id, err := strconv.ParseUint(name, 10, 32); err == nil {
+		return uint32(id), nil
+	}
+	var idStr string
+	if group {
+		g, err := user.LookupGroup(name)
+		if err != nil {
+			return 0, err
+		}
+		idStr = g.Gid
+	} else {
+		u, err := user.Lookup(name)
+		if err != nil {
+			return 0, err
+		}
+		idStr = u.Uid
+	}
+	id, err := strconv.ParseUint(idStr, 10, 32)
+	if err != nil {
+		return 0, errors.New("non-numeric id for " + name)
+	}
+	return uint32(id), nil
+}
+
+// peerIsAdmin reports whether the request came over the unix socket from a
+// process whose uid is listed in UnixConfig.AdminPeers, and that uid.
+func peerIsAdmin(c *fiber.Ctx) (uint32, bool) {
+	pc, ok := c.Context().Conn().(*peerConn)
+	if !ok || !pc.credOK {
+		return 0, false
+	}
+	admins := serverOf(c).peerAdmins
+	return pc.uid, admins.any || admins.uids[pc.uid]
+}
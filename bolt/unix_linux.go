@@ -0,0 +1,27 @@
+package bolt
+
+import (
+	"net"
+	"syscall"
+)
+
+func peerCred(conn *net.UnixConn) (uid, gid uint32, pid int32, err error) {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	var (
+		cred    *syscall.Ucred
+		credErr error
+	)
+	err = raw.Control(func(fd uintptr) {
+		cred, credErr = syscall.GetsockoptUcred(int(fd), syscall.SOL_SOCKET, syscall.SO_PEERCRED)
+	})
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	if credErr != nil {
+		return 0, 0, 0, credErr
+	}
+	return cred.Uid, cred.Gid, cred.Pid, nil
+}
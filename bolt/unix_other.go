@@ -0,0 +1,13 @@
+//go:build !linux
+
+package bolt
+
+import (
+	"errors"
+	"net"
+)
+
+// SO_PEERCRED is Linux only; elsewhere unix socket peers are never trusted.
+func peerCred(conn *net.UnixConn) (uid, gid uint32, pid int32, err error) {
+	return 0, 0, 0, errors.New("peer credentials are not supported on this platform")
+}
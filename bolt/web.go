@@ -1,49 +1,190 @@
 package bolt
 
 import (
+	"errors"
+	"fmt"
+	"math"
 	"net/http"
+	"net/url"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/gofiber/fiber/v2"
 	"github.com/gofiber/fiber/v2/middleware/filesystem"
 )
 
-type UserState struct {
-	Bucket string
-	Page   int
-	Start  int
-	Step   int
+// sessionCookie holds the web console session created by POST /web/login.
+const sessionCookie = "boltbase_session"
+
+// webAuth authenticates a web console request. The session cookie is only
+// accepted here, the REST API keeps using the Authorization header.
+func webAuth(c *fiber.Ctx) (AuthResult, error) {
+	if o, ok := c.Locals(authLocal).(authOutcome); ok {
+		return o.res, o.err
+	}
+	if token := c.Cookies(sessionCookie); token != "" {
+		u, _, err := webSessionUser(serverOf(c).db, token)
+		if err == nil {
+			var res AuthResult
+			res.HaveAdminBucket = true
+			res.setUser(u)
+			c.Locals(authLocal, authOutcome{res, nil})
+			setActor(c, res.Actor)
+			return res, nil
+		}
+		if err != ErrKeyNotFound {
+			return AuthResult{}, err
+		}
+	}
+	return auth(c)
 }
 
-var userState = UserState{Step: 25}
+// webAuthorize is authorize for the web console.
+func webAuthorize(c *fiber.Ctx, scope string) (AuthResult, error) {
+	res, err := webAuth(c)
+	if err != nil {
+		return res, err
+	}
+	if !res.Can(scope) {
+		return res, fmt.Errorf("%w: %s lacks scope %q", ErrFooForbidden, res.Actor, scope)
+	}
+	return res, nil
+}
+
+// webDenied answers a web request that failed webAuth or webAuthorize.
+// Unauthenticated HTMX requests get an HX-Redirect to the login page, plain
+// page loads a normal redirect.
+func webDenied(c *fiber.Ctx, err error) error {
+	switch {
+	case errors.Is(err, ErrFooForbidden):
+		return c.SendStatus(403)
+	case err == ErrFooUnauthorized:
+		if c.Get("HX-Request") == "true" {
+			c.Set("HX-Redirect", "/web/login")
+			return c.SendStatus(401)
+		}
+		return c.Redirect("/web/login")
+	default:
+		return c.SendStatus(500)
+	}
+}
 
 func index(c *fiber.Ctx) error {
+	auth, err := webAuth(c)
+	if err != nil {
+		return webDenied(c, err)
+	}
 	return c.Render("index", fiber.Map{
 		"Title": "HTMX + Go (Fiber) Demos",
+		"Actor": auth.Actor,
+		// 只有通过 cookie 登录时才显示退出按钮
+		"LoggedIn": c.Cookies(sessionCookie) != "" && auth.Username != "",
+	})
+}
+
+func loginPage(c *fiber.Ctx) error {
+	if _, err := webAuth(c); err == nil {
+		return c.Redirect("/")
+	}
+	return c.Render("login", fiber.Map{})
+}
+
+// webLogin checks the login form and sets the session cookie.
+func webLogin(c *fiber.Ctx) error {
+	username, password := c.FormValue("username"), c.FormValue("password")
+	srv := serverOf(c)
+	keys := authLockoutKeys(c, username)
+	if d := srv.lockedFor(keys...); d > 0 {
+		c.Set(fiber.HeaderRetryAfter, strconv.Itoa(int(math.Ceil(d.Seconds()))))
+		return c.Status(429).Render("login", fiber.Map{
+			"Error":    "失败次数过多，请稍后再试",
+			"Username": username,
+		})
+	}
+	u, ok, err := checkPasswordFrom(c, username, password)
+	if err != nil {
+		return c.SendStatus(500)
+	}
+	if !ok {
+		return c.Status(401).Render("login", fiber.Map{
+			"Error":    "用户名或密码错误",
+			"Username": username,
+		})
+	}
+	srv.clearAuthFailures(userLockoutKey(u.Username))
+	setActor(c, "user:"+u.Username)
+	token, sess, err := newWebSession(srv.db, u, srv.Auth.RefreshTokenTTL)
+	if err != nil {
+		return c.SendStatus(500)
+	}
+	c.Cookie(&fiber.Cookie{
+		Name:     sessionCookie,
+		Value:    token,
+		Path:     "/",
+		Expires:  sess.Expiry,
+		Secure:   c.Protocol() == "https",
+		HTTPOnly: true,
+		SameSite: fiber.CookieSameSiteStrictMode,
 	})
+	return c.Redirect("/")
+}
+
+func webLogout(c *fiber.Ctx) error {
+	if token := c.Cookies(sessionCookie); token != "" {
+		db := serverOf(c).db
+		if _, sess, err := webSessionUser(db, token); err == nil {
+			if err := DeleteSession(db, sess.ID); err != nil && err != ErrKeyNotFound {
+				return c.SendStatus(500)
+			}
+		}
+	}
+	c.Cookie(&fiber.Cookie{
+		Name:     sessionCookie,
+		Path:     "/",
+		Expires:  time.Unix(0, 0),
+		HTTPOnly: true,
+		SameSite: fiber.CookieSameSiteStrictMode,
+	})
+	if c.Get("HX-Request") == "true" {
+		c.Set("HX-Redirect", "/web/login")
+		return c.SendStatus(204)
+	}
+	return c.Redirect("/web/login")
 }
 
 func favicon(c *fiber.Ctx) error {
-	if err := filesystem.SendFile(c, http.FS(WebFS), "web/public/favicon.ico"); err != nil {
+	if err := filesystem.SendFile(c, http.FS(serverOf(c).webFS), "web/public/favicon.ico"); err != nil {
 		return c.Status(404).SendString(err.Error())
 	}
 	return nil
 }
 
 func getBuckets(c *fiber.Ctx) error {
-	bucketList, err := ListBuckets(db)
+	db := serverOf(c).db
+	auth, err := webAuth(c)
+	if err != nil {
+		return webDenied(c, err)
+	}
+
+	stored, err := ListStoredBuckets(db)
 	if err != nil {
 		return c.SendStatus(500)
 	}
 
-	filtered := bucketList[:0]
-	for _, v := range bucketList {
-		if v == metadataBucket || v == adminBucket {
+	// 链接使用存储的名字，显示解码后的名字
+	type bucketItem struct{ Name, Stored string }
+	var bucketList []bucketItem
+	for _, v := range stored {
+		if isInternalBucket(v) || !auth.canSeeBucket(v) {
 			continue
 		}
-		filtered = append(filtered, v)
+		name, err := decodeURIComponent(v)
+		if err != nil {
+			name = v
+		}
+		bucketList = append(bucketList, bucketItem{Name: name, Stored: v})
 	}
-	bucketList = filtered
 
 	return c.Status(200).Render("HTMX/getBucket", fiber.Map{
 		"BucketList": bucketList,
@@ -51,10 +192,14 @@ func getBuckets(c *fiber.Ctx) error {
 }
 
 func getAll(c *fiber.Ctx) error {
+	db := serverOf(c).db
 	bucketName := c.FormValue("bucketName")
-	if bucketName == metadataBucket || bucketName == adminBucket {
+	if isInternalBucket(bucketName) {
 		return c.SendStatus(403)
 	}
+	if _, err := webAuthorize(c, bucketScope("read", bucketName)); err != nil {
+		return webDenied(c, err)
+	}
 
 	keyType, err := GetKV(db, metadataBucket, bucketName)
 	if err != nil {
@@ -83,125 +228,171 @@ func getAll(c *fiber.Ctx) error {
 	})
 }
 
-func setBucket(c *fiber.Ctx) error {
-	bucketNameUnsafe := c.Params("bucketName")
+// webView is the page of a bucket shown in the web console. It travels in
+// the query string of every HTMX request (?bucket=&page=&step=) instead of
+// living on the server, so every browser and tab pages independently.
+type webView struct {
+	Bucket string
+	Page   int // 从 0 开始
+	Step   int
+}
 
-	bucketName := strings.Clone(bucketNameUnsafe)
+const (
+	defaultWebStep = 25
+	maxWebStep     = 200 // 一页最多显示的条数，避免一次扫描整个 bucket
+)
 
-	userState.Bucket = bucketName
-	userState.Page = 0
-	userState.Start = 0
+// parseWebView reads the view from the query string and checks that the
+// request may read its bucket.
+func parseWebView(c *fiber.Ctx) (webView, error) {
+	v := webView{
+		Bucket: c.Query("bucket"),
+		Page:   c.QueryInt("page", 1) - 1,
+		Step:   webStep(c),
+	}
+	if v.Page < 0 {
+		v.Page = 0
+	}
+	return v, webAuthorizeBucket(c, v.Bucket)
+}
 
-	return sendPart(c)
+// webStep returns the step query parameter, defaulted and capped at
+// maxWebStep.
+func webStep(c *fiber.Ctx) int {
+	step := c.QueryInt("step", defaultWebStep)
+	if step <= 0 {
+		return defaultWebStep
+	}
+	return min(step, maxWebStep)
 }
 
-func setPage(c *fiber.Ctx) error {
-	pageInt, err := c.ParamsInt("page")
-	if err != nil {
-		return c.SendStatus(500)
+// webBucketParam returns the :bucketName parameter of the console routes.
+// The templates path-escape the (stored) name, so it is unescaped once here.
+func webBucketParam(c *fiber.Ctx) string {
+	name := c.Params("bucketName")
+	if dec, err := url.PathUnescape(name); err == nil {
+		return dec
 	}
+	return name
+}
 
-	if pageInt <= 0 {
-		return c.SendStatus(400)
+// webAuthorizeBucket checks that the request may read bucketName.
+func webAuthorizeBucket(c *fiber.Ctx, bucketName string) error {
+	if bucketName == "" || isInternalBucket(bucketName) {
+		return ErrFooForbidden
 	}
+	_, err := webAuthorize(c, bucketScope("read", bucketName))
+	return err
+}
 
-	pageInt--
+func setBucket(c *fiber.Ctx) error {
+	bucketName := webBucketParam(c)
+	if err := webAuthorizeBucket(c, bucketName); err != nil {
+		return webDenied(c, err)
+	}
 
-	count, err := CountBucketKV(db, userState.Bucket)
+	return sendPart(c, webView{
+		Bucket: bucketName,
+		Step:   webStep(c),
+	})
+}
+
+func setPage(c *fiber.Ctx) error {
+	v, err := parseWebView(c)
 	if err != nil {
-		return c.SendStatus(500)
+		return webDenied(c, err)
 	}
 
-	var maxPage int = (count+userState.Step-1)/userState.Step - 1
-
-	if pageInt > maxPage {
-		pageInt = maxPage
+	pageInt, err := c.ParamsInt("page")
+	if err != nil {
+		return c.SendStatus(500)
 	}
 
-	if count < userState.Step {
-		pageInt = 0
+	if pageInt <= 0 {
+		return c.SendStatus(400)
 	}
 
-	userState.Page = pageInt
-	userState.Start = pageInt * userState.Step
+	v.Page = pageInt - 1
 
-	return sendPart(c)
+	return sendPart(c, v)
 }
 
 func setStep(c *fiber.Ctx) error {
+	v, err := parseWebView(c)
+	if err != nil {
+		return webDenied(c, err)
+	}
+
 	stepInt, err := c.ParamsInt("step")
 	if err != nil {
 		return c.SendStatus(500)
 	}
 
-	if stepInt <= 0 {
+	if stepInt <= 0 || stepInt > maxWebStep {
 		return c.SendStatus(400)
 	}
 
-	userState.Step = stepInt
-	userState.Start = stepInt * userState.Page
+	v.Step = stepInt
 
-	return sendPart(c)
+	return sendPart(c, v)
 }
 
 func changePage(c *fiber.Ctx) error {
+	v, err := parseWebView(c)
+	if err != nil {
+		return webDenied(c, err)
+	}
+
 	directionUnsafe := c.Params("direction")
 
 	direction := strings.Clone(directionUnsafe)
 
-	count, err := CountBucketKV(db, userState.Bucket)
-	if err != nil {
-		return c.SendStatus(500)
+	if direction == "left" && v.Page != 0 {
+		v.Page--
 	}
 
-	if direction == "left" && userState.Page != 0 {
-		userState.Page = userState.Page - 1
-		userState.Start = userState.Page * userState.Step
+	if direction == "right" {
+		v.Page++
 	}
 
-	if direction == "right" && userState.Page != (count+userState.Step-1)/userState.Step-1 {
-		userState.Page = userState.Page + 1
-		userState.Start = userState.Page * userState.Step
-	}
-
-	return sendPart(c)
+	return sendPart(c, v)
 }
 
-func sendPart(c *fiber.Ctx) error {
-	keyType, err := GetKV(db, metadataBucket, userState.Bucket)
+// sendPart renders page v.Page of v.Bucket. Pages past the end show the
+// last page.
+func sendPart(c *fiber.Ctx, v webView) error {
+	if v.Step <= 0 {
+		v.Step = defaultWebStep
+	}
+
+	db := serverOf(c).db
+	keyType, err := GetKV(db, metadataBucket, v.Bucket)
 	if err != nil {
 		return c.SendStatus(500)
 	}
 
-	count, err := CountBucketKV(db, userState.Bucket)
+	count, err := CountBucketKV(db, v.Bucket)
 	if err != nil {
 		return c.SendStatus(500)
 	}
 
-	totalPage := int((count + userState.Step - 1) / userState.Step)
+	totalPage := int((count + v.Step - 1) / v.Step)
 	num := make([]int, totalPage)
 	for i := 0; i < totalPage; i++ {
 		num[i] = i + 1
 	}
 
-	if keyType == "seq" {
-		kv, err := PartScanSeq(db, userState.Bucket, userState.Start, userState.Step)
-		if err != nil {
-			return c.SendStatus(500)
-		}
-
-		return c.Status(200).Render("HTMX/getPart", fiber.Map{
-			"totalKV":     count,
-			"total":       len(kv),
-			"kv":          kv,
-			"totalPage":   int((count + userState.Step - 1) / userState.Step),
-			"currentPage": userState.Page + 1,
-			"numList":     num,
-			"bucketName":  userState.Bucket,
-		})
+	if v.Page > totalPage-1 {
+		v.Page = max(totalPage-1, 0)
 	}
+	start := v.Page * v.Step
 
-	kv, err := PartScan(db, userState.Bucket, userState.Start, userState.Step)
+	var kv map[string]string
+	if keyType == "seq" {
+		kv, err = PartScanSeq(db, v.Bucket, start, v.Step)
+	} else {
+		kv, err = PartScan(db, v.Bucket, start, v.Step)
+	}
 	if err != nil {
 		return c.SendStatus(500)
 	}
@@ -210,30 +401,23 @@ func sendPart(c *fiber.Ctx) error {
 		"totalKV":     count,
 		"total":       len(kv),
 		"kv":          kv,
-		"totalPage":   int((count + userState.Step - 1) / userState.Step),
-		"currentPage": userState.Page + 1,
+		"totalPage":   totalPage,
+		"currentPage": v.Page + 1,
+		"step":        v.Step,
 		"numList":     num,
-		"bucketName":  userState.Bucket,
+		"bucketName":  v.Bucket,
 	})
 }
 
 func getInfoWeb(c *fiber.Ctx) error {
-	bucketName := c.Params("bucketName")
-	if bucketName == metadataBucket || bucketName == adminBucket {
+	db := serverOf(c).db
+	bucketName := webBucketParam(c)
+	if isInternalBucket(bucketName) {
 		return c.SendStatus(403)
 	}
 
-	auth, err := auth(c.Get("Authorization"))
-	if err != nil && err != ErrFooUnauthorized {
-		return c.SendStatus(500)
-	}
-	if err == ErrFooUnauthorized {
-		return c.SendStatus(401)
-	}
-	if !auth.IsAdmin {
-		if bucketName == apiKeyBucket {
-			return c.SendStatus(403)
-		}
+	if _, err := webAuthorize(c, bucketScope("read", bucketName)); err != nil {
+		return webDenied(c, err)
 	}
 	info, err := GetInfo(db, bucketName)
 	if err != nil {
@@ -245,10 +429,17 @@ func getInfoWeb(c *fiber.Ctx) error {
 }
 
 func debug(c *fiber.Ctx) error {
+	auth, err := webAuth(c)
+	if err != nil {
+		return webDenied(c, err)
+	}
+	if !auth.IsAdmin {
+		return c.SendStatus(403)
+	}
 	return c.Status(200).JSON(fiber.Map{
-		"bucket": userState.Bucket,
-		"start":  userState.Start,
-		"step":   userState.Step,
-		"page":   userState.Page,
+		"bucket": c.Query("bucket"),
+		"page":   c.QueryInt("page", 1),
+		"step":   c.QueryInt("step", defaultWebStep),
+		"actor":  auth.Actor,
 	})
 }
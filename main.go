@@ -3,18 +3,34 @@ package main
 import (
 	"Boltbase/bolt"
 	"embed"
+	"errors"
+	"flag"
 	"log"
+	"os"
 )
 
 //go:embed web
 var webFS embed.FS
 
 func main() {
-	if err := bolt.InitDB(); err != nil {
+	cfg, err := bolt.LoadConfig(os.Args[1:])
+	if errors.Is(err, flag.ErrHelp) {
+		return
+	}
+	if err != nil {
+		log.Fatalf("Failed to load the configuration\n%v", err)
+	}
+
+	db, err := bolt.InitDB(cfg.DBPath, cfg.DB)
+	if err != nil {
 		log.Fatalf("Failed to initialize the database\n%v", err)
 	}
-	defer bolt.DB.Close()
-	bolt.WebFS = webFS
 
-	bolt.Run("Boltbase v2.0", 5090, bolt.Routes, webFS)
+	err = bolt.Run(cfg, db, bolt.Routes, webFS)
+	if cerr := bolt.CloseDB(db); cerr != nil {
+		log.Printf("Failed to close the database\n%v", cerr)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
 }
@@ -17,6 +17,10 @@ var SendSum int = 1000
 var ReadConcurrency int = 10
 var ReadSum int = 10000
 
+// 不同写入并发下的吞吐，用于观察服务端 group commit (groupUpdate 写入队列) 的效果
+var WriteScale = []int{1, 10, 50, 100}
+var WriteScaleSum int = 2000
+
 //
 //=============================
 
@@ -37,6 +41,9 @@ func main() {
 	createBucket(client)
 	writeTimer(WriteConcurrency, SendSum, "Seq", "test1", client, sent)
 	writeTimer(WriteConcurrency, SendSum, "Time", "test2", client, sent)
+	for _, c := range WriteScale {
+		writeTimer(c, WriteScaleSum, fmt.Sprintf("Seq (concurrency %d)", c), "test1", client, sent)
+	}
 	readTimer(ReadConcurrency, ReadSum, "Seq", map[string]string{"type": "get", "bucket": "test1", "Q": "1"}, client, read)
 	readTimer(ReadConcurrency, ReadSum, "Seq", map[string]string{"type": "all", "bucket": "test1", "Q": ""}, client, read)
 	readTimer(ReadConcurrency, ReadSum, "Time", map[string]string{"type": "all", "bucket": "test2", "Q": ""}, client, read)
@@ -159,12 +166,14 @@ func setPassword(client *req.Client) {
 
 func setApiKey(client *req.Client) {
 	type ApiKey struct {
-		Duration string `json:"duration"`
+		Duration string   `json:"duration"`
+		Scopes   []string `json:"scopes"`
 	}
 	resp, err := client.R().
 		SetBasicAuth("zy", "123").
 		SetBody(&ApiKey{
 			Duration: "365d",
+			Scopes:   []string{"*"},
 		}).
 		SetSuccessResult(&apiKeyResult).
 		Post("http://localhost:5090/auth/apikey")